@@ -0,0 +1,93 @@
+package yesdns
+
+// Access control lists that limit which clients may query a listener or resolver.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Values for Acl.Action
+const (
+	// Respond with REFUSED. The default.
+	AclRefuse = "refuse"
+	// Don't respond at all
+	AclDrop = "drop"
+)
+
+// A client is denied if it matches Deny, or if Allow is not empty and the client doesn't match it.
+// Entries are CIDRs or plain IP addresses.
+type Acl struct {
+	Allow  []string `json:"allow,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+	Action string   `json:"action,omitempty"`
+}
+
+func (a Acl) Denies(clientIp net.IP) bool {
+	if clientIp == nil {
+		// We can't tell who the client is, so only let it through if there is no allow list
+		return len(a.Allow) > 0
+	}
+	for _, cidr := range a.Deny {
+		// An invalid entry denies everyone, so that a typo can't open up the ACL
+		if network := parseCidr(cidr); network == nil || network.Contains(clientIp) {
+			return true
+		}
+	}
+	return len(a.Allow) > 0 && !cidrsContain(a.Allow, clientIp)
+}
+
+func (a *Acl) validate() error {
+	if a == nil {
+		return nil
+	}
+	if err := validateCidrs(a.Allow); err != nil {
+		return err
+	}
+	if err := validateCidrs(a.Deny); err != nil {
+		return err
+	}
+	if a.Action != "" && a.Action != AclRefuse && a.Action != AclDrop {
+		return errors.New(fmt.Sprintf("Unknown ACL action '%s'. Must be %s or %s", a.Action, AclRefuse, AclDrop))
+	}
+	return nil
+}
+
+// Checks the ACLs of the resolver, its listeners and its zone transfers
+func (r Resolver) validateAcls() error {
+	acls := []*Acl{r.Acl}
+	for _, listener := range r.Listeners {
+		acls = append(acls, listener.Acl)
+	}
+	for _, zone := range r.Zones {
+		if zone.Transfer != nil {
+			acls = append(acls, zone.Transfer.Acl)
+		}
+	}
+	for _, acl := range acls {
+		if err := acl.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a Acl) action() string {
+	if a.Action == AclDrop {
+		return AclDrop
+	}
+	return AclRefuse
+}
+
+// Returns AclRefuse or AclDrop if clientIp is denied by the ACL of listener or of the resolver, otherwise "".
+// The listener ACL is checked first.
+func (r Resolver) aclAction(listener ResolverListener, clientIp net.IP) string {
+	listener = r.currentListener(listener)
+	for _, acl := range []*Acl{listener.Acl, r.Acl} {
+		if acl != nil && acl.Denies(clientIp) {
+			return acl.action()
+		}
+	}
+	return ""
+}
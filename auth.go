@@ -0,0 +1,202 @@
+package yesdns
+
+// Authentication and authorization for the REST API.
+//
+// Callers present a bearer token: Authorization: Bearer <token>
+// Each token has a scope. ScopeRead allows GET and HEAD, ScopeWrite allows everything.
+// Tokens can be limited to the resolvers of one tenant, see tenant.go.
+// If no tokens are configured, the REST API is open to everyone.
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Token scopes
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+type ApiToken struct {
+	Token  string
+	Scope  string
+	Tenant string
+}
+
+var (
+	apiTokens      []ApiToken
+	apiTokensMutex sync.RWMutex
+)
+
+// Replaces the tokens that may use the REST API. No tokens disables authentication.
+func SetApiTokens(tokens []ApiToken) {
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	apiTokens = tokens
+}
+
+// Parses token:scope or token:scope:tenant entries separated by commas, whitespace or newlines.
+func ParseApiTokens(spec string) (error, []ApiToken) {
+	var tokens []ApiToken
+	for _, entry := range strings.FieldsFunc(spec, func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r'
+	}) {
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return errors.New(fmt.Sprintf("Invalid API token entry %s. Expected token:scope or token:scope:tenant", entry)), nil
+		}
+		if parts[1] != ScopeRead && parts[1] != ScopeWrite {
+			return errors.New(fmt.Sprintf("Invalid API token scope %s. Expected %s or %s", parts[1], ScopeRead, ScopeWrite)), nil
+		}
+		token := ApiToken{Token: parts[0], Scope: parts[1]}
+		if len(parts) == 3 {
+			token.Tenant = parts[2]
+		}
+		tokens = append(tokens, token)
+	}
+	return nil, tokens
+}
+
+// Reads a file with one token:scope or token:scope:tenant per line. Lines starting with # are ignored.
+func ReadApiTokensFile(path string) (error, []ApiToken) {
+	file, err := os.Open(path)
+	if err != nil {
+		return err, nil
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err, nil
+	}
+	return ParseApiTokens(strings.Join(lines, "\n"))
+}
+
+// Returns the token presented with r, or nil if it is missing or unknown.
+// Returns ok false if authentication is disabled.
+func requestToken(r *http.Request) (*ApiToken, bool) {
+	apiTokensMutex.RLock()
+	defer apiTokensMutex.RUnlock()
+	if len(apiTokens) == 0 {
+		return nil, false
+	}
+	presented := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if presented == "" {
+		return nil, true
+	}
+	var found *ApiToken
+	// Compare every token in constant time, so response time doesn't tell how much of a token was right
+	for i := range apiTokens {
+		if subtle.ConstantTimeCompare([]byte(apiTokens[i].Token), []byte(presented)) == 1 {
+			found = &apiTokens[i]
+		}
+	}
+	return found, true
+}
+
+// Scope needed to use method
+func requiredScope(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// Someone who authenticated to the REST API. A request can have several, e.g. a token and a client certificate,
+// and must be allowed by all of them.
+type apiPrincipal struct {
+	// For logging
+	Name  string
+	Scope string
+	// Resolver ids the principal may write to. Empty means all.
+	Resolvers []string
+	// Tenant whose resolvers the principal may write to. Empty means all tenants.
+	Tenant string
+}
+
+func (p apiPrincipal) allowsResolver(resolverId string) bool {
+	if len(p.Resolvers) == 0 {
+		return true
+	}
+	for _, allowed := range p.Resolvers {
+		if allowed == resolverId {
+			return true
+		}
+	}
+	return false
+}
+
+type apiPrincipalsKey struct{}
+
+func requestPrincipals(r *http.Request) []apiPrincipal {
+	principals, _ := r.Context().Value(apiPrincipalsKey{}).([]apiPrincipal)
+	return principals
+}
+
+// True if every principal of r may write to all of resolverIds
+func authorizedForResolvers(r *http.Request, resolverIds ...string) bool {
+	for _, principal := range requestPrincipals(r) {
+		for _, resolverId := range resolverIds {
+			if !principal.allowsResolver(resolverId) {
+				logger.Info("Principal not allowed to write resolver", "principal", principal.Name, "resolver", resolverId)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// True if every principal of r may see resolverId. Like authorizedForResolvers, but quiet, for filtering lists.
+func principalsAllowResolver(r *http.Request, resolverId string) bool {
+	for _, principal := range requestPrincipals(r) {
+		if !principal.allowsResolver(resolverId) {
+			return false
+		}
+	}
+	return true
+}
+
+// Wraps the REST API so that handler is only called for authenticated principals of sufficient scope.
+// Responds 401 Unauthorized if there is no valid token, and 403 Forbidden if the client certificate subject is unknown
+// or the scope is insufficient.
+func authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var principals []apiPrincipal
+		if token, enabled := requestToken(r); enabled {
+			if token == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="yesdns"`)
+				http.Error(w, "Missing or invalid bearer token\n", http.StatusUnauthorized)
+				return
+			}
+			principals = append(principals, apiPrincipal{Name: "token", Scope: token.Scope, Tenant: token.Tenant})
+		}
+		if subject, enabled := requestClientSubject(r); enabled {
+			if subject == nil {
+				http.Error(w, "Client certificate subject not allowed\n", http.StatusForbidden)
+				return
+			}
+			principals = append(principals, apiPrincipal{Name: subject.Subject, Scope: subject.Scope,
+				Resolvers: subject.Resolvers, Tenant: subject.Tenant})
+		}
+		for _, principal := range principals {
+			if principal.Scope != ScopeWrite && requiredScope(r.Method) == ScopeWrite {
+				http.Error(w, fmt.Sprintf("Scope %s does not allow %s\n", principal.Scope, r.Method), http.StatusForbidden)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiPrincipalsKey{}, principals)))
+	})
+}
@@ -4,15 +4,14 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
-	"log"
+	"time"
 	"github.com/alangibson/yesdns"
 )
 
 func main() {
 	// User-provided parameters
-	// TODO support TSIG via /v1/resolvers api
-	// var tsigName, tsigSecret string
 
 	// Via environment variables
 	httpListen, ok := os.LookupEnv("YESDNS_HTTP_LISTEN")
@@ -21,18 +20,98 @@ func main() {
 	if ! ok { dbDir = "./db/v1" }
 	tlsCertFile, ok := os.LookupEnv("YESDNS_TLS_CERT_FILE")
 	tlsKeyFile, ok := os.LookupEnv("YESDNS_TLS_KEY_FILE")
+	tlsClientCaFile, ok := os.LookupEnv("YESDNS_TLS_CLIENT_CA_FILE")
+	tlsClientSubjectsFile, ok := os.LookupEnv("YESDNS_TLS_CLIENT_SUBJECTS_FILE")
+	logLevel, ok := os.LookupEnv("YESDNS_LOG_LEVEL")
+	if ! ok { logLevel = "info" }
+	dnstapTarget, ok := os.LookupEnv("YESDNS_DNSTAP")
+	apiTokens, ok := os.LookupEnv("YESDNS_API_TOKENS")
+	apiTokensFile, ok := os.LookupEnv("YESDNS_API_TOKENS_FILE")
+	gcInterval := 10 * time.Second
+	var gcIntervalErr error
+	if value, ok := os.LookupEnv("YESDNS_GC_INTERVAL"); ok {
+		gcInterval, gcIntervalErr = time.ParseDuration(value)
+	}
+	queryLogSize := yesdns.DefaultQueryLogSize
+	var queryLogSizeErr error
+	if value, ok := os.LookupEnv("YESDNS_QUERY_LOG_SIZE"); ok {
+		queryLogSize, queryLogSizeErr = strconv.Atoi(value)
+	}
 	// Via command line
 	flag.StringVar(&httpListen, "http-listen", httpListen, "IP address and TCP port to serve HTTP on. Also env var YESDNS_HTTP_LISTEN")
 	flag.StringVar(&dbDir, "db-dir", dbDir, "Directory to store Scribble database in. Also env var YESDNS_DB_DIR")
 	flag.StringVar(&tlsCertFile, "tls-cert-file", tlsCertFile, "Also env var YESDNS_TLS_CERT_FILE")
 	flag.StringVar(&tlsKeyFile, "tls-key-file", tlsKeyFile, "Also env var YESDNS_TLS_KEY_FILE")
+	flag.StringVar(&tlsClientCaFile, "tls-client-ca-file", tlsClientCaFile, "Require REST API clients to present a certificate signed by a CA in this file. Also env var YESDNS_TLS_CLIENT_CA_FILE")
+	flag.StringVar(&tlsClientSubjectsFile, "tls-client-subjects-file", tlsClientSubjectsFile, "JSON file that maps client certificate subjects to scopes and resolvers. Also env var YESDNS_TLS_CLIENT_SUBJECTS_FILE")
+	flag.StringVar(&logLevel, "log-level", logLevel, "One of debug, info, warn or error. Also env var YESDNS_LOG_LEVEL")
+	flag.IntVar(&queryLogSize, "query-log-size", queryLogSize, "Number of queries kept for GET /v1/queries. 0 disables. Also env var YESDNS_QUERY_LOG_SIZE")
+	flag.StringVar(&dnstapTarget, "dnstap", dnstapTarget, "Write dnstap to unix:///path/to/socket or to a file. Also env var YESDNS_DNSTAP")
+	flag.DurationVar(&gcInterval, "gc-interval", gcInterval, "How often expired records and resolvers are deleted. 0 disables. Also env var YESDNS_GC_INTERVAL")
+	flag.StringVar(&apiTokens, "api-tokens", apiTokens, "Comma separated token:scope pairs for the REST API. Scope is read or write. Also env var YESDNS_API_TOKENS")
+	flag.StringVar(&apiTokensFile, "api-tokens-file", apiTokensFile, "File with one token:scope per line. Also env var YESDNS_API_TOKENS_FILE")
 	flag.Parse()
 
+	logger := yesdns.Logger()
+	if err := yesdns.SetLogLevel(logLevel); err != nil {
+		logger.Error("Invalid log level", "error", err)
+		return
+	}
+	if gcIntervalErr != nil {
+		logger.Error("Invalid YESDNS_GC_INTERVAL", "error", gcIntervalErr)
+		return
+	}
+	if queryLogSizeErr != nil {
+		logger.Error("Invalid YESDNS_QUERY_LOG_SIZE", "error", queryLogSizeErr)
+		return
+	}
+	if queryLogSize < 0 {
+		logger.Error("Invalid query log size", "size", queryLogSize)
+		return
+	}
+	yesdns.SetQueryLogSize(queryLogSize)
+	err, tokens := yesdns.ParseApiTokens(apiTokens)
+	if err != nil {
+		logger.Error("Invalid API tokens", "error", err)
+		return
+	}
+	if apiTokensFile != "" {
+		err, fileTokens := yesdns.ReadApiTokensFile(apiTokensFile)
+		if err != nil {
+			logger.Error("Could not read API tokens file", "file", apiTokensFile, "error", err)
+			return
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+	if len(tokens) == 0 && tlsClientCaFile == "" {
+		logger.Warn("No API tokens configured. REST API is open to everyone.")
+	}
+	yesdns.SetApiTokens(tokens)
+	if tlsClientSubjectsFile != "" {
+		if tlsClientCaFile == "" {
+			logger.Error("-tls-client-subjects-file requires -tls-client-ca-file")
+			return
+		}
+		err, subjects := yesdns.ReadClientSubjectsFile(tlsClientSubjectsFile)
+		if err != nil {
+			logger.Error("Could not read client subjects file", "file", tlsClientSubjectsFile, "error", err)
+			return
+		}
+		yesdns.SetClientSubjects(subjects)
+	}
+	if dnstapTarget != "" {
+		if err := yesdns.StartDnstap(dnstapTarget); err != nil {
+			logger.Error("Could not start dnstap", "target", dnstapTarget, "error", err)
+			return
+		}
+		defer yesdns.StopDnstap()
+	}
+
 	// Initialize database
 	// TODO Sanitize dbDir. Should lot allow '..'
 	err, database := yesdns.NewDatabase(dbDir)
 	if err != nil {
-		log.Printf("ERROR Could not open database %s\n", dbDir)
+		logger.Error("Could not open database", "db_dir", dbDir, "error", err)
 		return
 	}
 
@@ -42,13 +121,16 @@ func main() {
 	// Start up resolver manager
 	go yesdns.SyncServersWithDatabase(database, reloadChannel)
 
+	// Start up garbage collection of expired records
+	go yesdns.CollectExpired(database, reloadChannel, gcInterval)
+
 	// Start up REST API
-	go yesdns.ServeRestApi(httpListen, database, reloadChannel, tlsCertFile, tlsKeyFile)
+	go yesdns.ServeRestApi(httpListen, database, reloadChannel, tlsCertFile, tlsKeyFile, tlsClientCaFile)
 
 	// Wait for process to be stopped by user
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	log.Println("INFO Waiting forever for SIGINT OR SIGTERM")
+	logger.Info("Waiting forever for SIGINT OR SIGTERM")
 	s := <-sig
-	log.Printf("INFO Signal (%s) received, stopping\n", s)
+	logger.Info("Signal received, stopping", "signal", s.String())
 }
@@ -4,10 +4,17 @@ package yesdns
 // resolver.go/
 import (
 	"github.com/nanobox-io/golang-scribble"
-	"log"
+	"github.com/miekg/dns"
 	"strconv"
+	"strings"
 	"encoding/json"
 	"bytes"
+	"os"
+	"path/filepath"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 )
 
 //
@@ -16,6 +23,8 @@ import (
 
 type Database struct {
 	db	*scribble.Driver
+	// Scribble has no way to list collections, so we do it ourselves
+	dir	string
 }
 
 func NewDatabase(scribbleDbDir string) (error, *Database) {
@@ -23,33 +32,65 @@ func NewDatabase(scribbleDbDir string) (error, *Database) {
 	if err != nil {
 		return err, nil
 	}
-	database := Database{db: db}
+	database := Database{db: db, dir: scribbleDbDir}
 	return nil, &database
 }
 
+// Resource name of the records of a zone of a resolver, e.g. its DNSSEC key or journal. Resolver ids can't contain #
+// (see validateResolverId), so resources of different resolvers and zones can't collide.
+func zoneResource(resolverId string, zone string) string {
+	return resolverId + "#" + dns.CanonicalName(zone)
+}
+
+// Collection that holds the DnsMessages of one resolver and qtype
+func dnsMessageKey(resolverId string, qtype uint16) string {
+	return resolverId + "/" + strconv.Itoa(int(qtype))
+}
+
 func (d Database) WriteDnsMessage(dnsRecord DnsMessage) error {
-	log.Printf("DEBUG Saving %s to db\n", dnsRecord)
+	dnsRecord.ExpiresAt = expiresAt(dnsRecord.ExpiresAt, dnsRecord.TtlSeconds)
+	logger.Debug("Saving DNS message to db", "message", dnsRecord)
 	// We create records for every resolver
 	for _, resolverId := range dnsRecord.Resolvers {
-		// We have 1 document in the db for every entry in Question section
-		for _, question := range dnsRecord.Question {
-			key := resolverId + "/" + strconv.Itoa(int(question.Qtype))
-			err := d.db.Write(key, question.Qname, dnsRecord)
-			if err != nil {
-				return err
-			}
+		if err := d.writeStoredDnsMessage(viewStorageId(resolverId, dnsRecord.View), dnsRecord); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes dnsRecord under storageId only (see viewStorageId and secondaryStorageId)
+func (d Database) writeStoredDnsMessage(storageId string, dnsRecord DnsMessage) error {
+	// We have 1 document in the db for every entry in Question section
+	for _, question := range dnsRecord.Question {
+		key := dnsMessageKey(storageId, question.Qtype)
+		err := d.db.Write(key, question.Qname, dnsRecord)
+		if err != nil {
+			return err
+		}
+		resetResponseCount(responseCounterKey(storageId, question.Qtype, question.Qname))
+		resetFaultSequence(responseCounterKey(storageId, question.Qtype, question.Qname))
+		forgetNamesBelow(storageId)
+		expiryEntry := expiryIndexEntry{ResolverId: storageId, Qtype: question.Qtype, Qname: question.Qname}
+		if err := d.indexExpiry(expiryEntry, dnsRecord.ExpiresAt); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 func (d Database) WriteResolver(resolver Resolver) error {
+	resolver.ExpiresAt = expiresAt(resolver.ExpiresAt, resolver.TtlSeconds)
 	err := d.db.Write("resolvers", resolver.Id, resolver)
-	return err
+	if err != nil {
+		return err
+	}
+	resetFaultSequence(resolverFaultKey(resolver.Id))
+	return d.indexExpiry(expiryIndexEntry{ResolverId: resolver.Id}, resolver.ExpiresAt)
 }
 
 func (d Database) ReadDnsMessage(dnsRecord DnsMessage) (error, DnsMessage) {
-	log.Printf("DEBUG Querying DNS Record %s\n", dnsRecord)
+	logger.Debug("Querying DNS message", "message", dnsRecord)
 	question := dnsRecord.Question[0]
 	returnDnsRecord := DnsMessage{}
 	// TODO look up by resolver.id/question.qtype
@@ -59,12 +100,164 @@ func (d Database) ReadDnsMessage(dnsRecord DnsMessage) (error, DnsMessage) {
 
 func (d Database) ReadResolverDnsMessage(resolverId string, qtype uint16, qname string) (error, *DnsMessage) {
 	returnDnsRecord := DnsMessage{}
-	key := resolverId + "/" + strconv.Itoa(int(qtype))
+	key := dnsMessageKey(resolverId, qtype)
 	err := d.db.Read(key, qname, &returnDnsRecord)
 	return err, &returnDnsRecord
 }
 
+// Returns nil if there is no such resolver
+func (d *Database) ReadResolver(resolverId string) (error, *Resolver) {
+	err, resolvers := d.ReadAllResolvers()
+	for _, resolver := range resolvers {
+		if resolver.Id == resolverId {
+			return nil, resolver
+		}
+	}
+	return err, nil
+}
+
+// Ids that DnsMessages of resolverId are stored under: resolverId itself, its views (see viewStorageId) and its
+// secondary zones (see secondaryStorageId)
+func (d Database) storageIds(resolverId string) []string {
+	entries, _ := os.ReadDir(d.dir)
+	var storageIds []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && (name == resolverId || strings.HasPrefix(name, resolverId + "@") ||
+			strings.HasPrefix(name, resolverId + "#")) {
+			storageIds = append(storageIds, name)
+		}
+	}
+	return storageIds
+}
+
+// Resolver ids are storage ids, and prefixes of view and secondary storage ids (see storageIds), and so become file
+// names in the Database
+func validateResolverId(resolverId string) error {
+	if resolverId == "" || strings.ContainsAny(resolverId, "/\\@#") || strings.Contains(resolverId, "..") {
+		return errors.New(fmt.Sprintf("Invalid resolver id '%s'. Must not be empty or contain /, \\, @, # or ..", resolverId))
+	}
+	return nil
+}
+
+// Returns an error if zone is not a domain name, or could escape a resource name (see zoneResource)
+func validateZoneName(zone string) error {
+	if _, ok := dns.IsDomainName(zone); !ok || strings.ContainsAny(zone, "/\\") {
+		return errors.New(fmt.Sprintf("Invalid zone '%s'. Must be a domain name without / or \\", zone))
+	}
+	return nil
+}
+
+// Qtypes that have DnsMessages stored under resolverId (or a view storage id, see viewStorageId)
+func (d Database) storedQtypes(resolverId string) []uint16 {
+	entries, _ := os.ReadDir(filepath.Join(d.dir, resolverId))
+	var qtypes []uint16
+	for _, entry := range entries {
+		if qtype, err := strconv.ParseUint(entry.Name(), 10, 16); err == nil && entry.IsDir() {
+			qtypes = append(qtypes, uint16(qtype))
+		}
+	}
+	return qtypes
+}
+
+// Qnames that have DnsMessages of qtype stored under resolverId
+func (d Database) storedQnames(resolverId string, qtype uint16) []string {
+	entries, _ := os.ReadDir(filepath.Join(d.dir, dnsMessageKey(resolverId, qtype)))
+	var qnames []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			qnames = append(qnames, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	return qnames
+}
+
+// Names that have DnsMessages below them, by storage id, so that negative answers don't read every DnsMessage of the
+// storage id to find empty non-terminals. An index is rebuilt after a DnsMessage of its storage id is written or
+// deleted.
+var namesBelow = struct {
+	sync.Mutex
+	// Latest expiry of the DnsMessages below each name, nil if one of them doesn't expire
+	byStorageId map[string]map[string]*time.Time
+	// Number of changes to each storage id, so that an index built while it changed isn't kept
+	changes map[string]int
+}{byStorageId: make(map[string]map[string]*time.Time), changes: make(map[string]int)}
+
+func forgetNamesBelow(storageId string) {
+	namesBelow.Lock()
+	delete(namesBelow.byStorageId, storageId)
+	namesBelow.changes[storageId]++
+	namesBelow.Unlock()
+}
+
+// True if there are unexpired DnsMessages for names below name under storageId
+func (d Database) hasNamesBelow(storageId string, name string) bool {
+	namesBelow.Lock()
+	index, ok := namesBelow.byStorageId[storageId]
+	changes := namesBelow.changes[storageId]
+	namesBelow.Unlock()
+	if !ok {
+		index = d.indexNamesBelow(storageId)
+		namesBelow.Lock()
+		if namesBelow.changes[storageId] == changes {
+			namesBelow.byStorageId[storageId] = index
+		}
+		namesBelow.Unlock()
+	}
+	expiresAt, ok := index[dns.CanonicalName(name)]
+	return ok && !isExpired(expiresAt)
+}
+
+// Maps every ancestor of the qnames of storageId's DnsMessages to the latest expiry of the DnsMessages below it
+func (d Database) indexNamesBelow(storageId string) map[string]*time.Time {
+	index := make(map[string]*time.Time)
+	for _, qtype := range d.storedQtypes(storageId) {
+		for _, qname := range d.storedQnames(storageId, qtype) {
+			err, dnsMessage := d.ReadResolverDnsMessage(storageId, qtype, qname)
+			if err != nil {
+				continue
+			}
+			qname = dns.CanonicalName(qname)
+			for i, offset := range dns.Split(qname) {
+				if i == 0 {
+					continue
+				}
+				latest, ok := index[qname[offset:]]
+				if !ok || latest != nil && (dnsMessage.ExpiresAt == nil || dnsMessage.ExpiresAt.After(*latest)) {
+					index[qname[offset:]] = dnsMessage.ExpiresAt
+				}
+			}
+		}
+	}
+	return index
+}
+
+// Qtypes that have unexpired DnsMessages for qname under resolverId
+func (d Database) qtypesAt(resolverId string, qname string) []uint16 {
+	var qtypes []uint16
+	for _, qtype := range d.storedQtypes(resolverId) {
+		if err, dnsMessage := d.ReadResolverDnsMessage(resolverId, qtype, qname); err == nil && !dnsMessage.Expired() {
+			qtypes = append(qtypes, qtype)
+		}
+	}
+	return qtypes
+}
+
 func (d *Database) ReadAllResolvers() (error, []*Resolver) {
+	err, stored := d.ReadStoredResolvers()
+	var resolvers []*Resolver
+	for _, resolver := range stored {
+		if resolver.Expired() {
+			logger.Debug("Skipping expired resolver", "resolver", resolver.Id)
+		} else {
+			resolvers = append(resolvers, resolver)
+		}
+	}
+	return err, resolvers
+}
+
+// Like ReadAllResolvers, but includes expired resolvers that have not been collected yet
+func (d *Database) ReadStoredResolvers() (error, []*Resolver) {
 	jsonStrings, err := d.db.ReadAll("resolvers")
 	if len(jsonStrings) == 0 {
 		return err, nil
@@ -73,7 +266,7 @@ func (d *Database) ReadAllResolvers() (error, []*Resolver) {
 	for _, jsonString := range jsonStrings {
 		var resolver *Resolver
 		if err := json.NewDecoder(bytes.NewBufferString(jsonString)).Decode(&resolver); err != nil {
-			log.Printf("WARN Could not decode json: %s\n", err)
+			logger.Warn("Could not decode json", "error", err)
 		} else {
 			resolver.Database = d
 			resolvers = append(resolvers, resolver)
@@ -83,18 +276,27 @@ func (d *Database) ReadAllResolvers() (error, []*Resolver) {
 }
 
 func (d Database) DeleteDnsMessage(dnsRecord DnsMessage) error {
-	log.Printf("DEBUG Deleting DNS Record %s\n", dnsRecord)
+	logger.Debug("Deleting DNS message", "message", dnsRecord)
 	var err error
 	for _, resolverId := range dnsRecord.Resolvers {
-		key := resolverId + "/" + strconv.Itoa(int(dnsRecord.Question[0].Qtype))
-		err = d.db.Delete(key, dnsRecord.Question[0].Qname)
+		err = d.deleteResolverDnsMessage(viewStorageId(resolverId, dnsRecord.View), dnsRecord.Question[0].Qtype, dnsRecord.Question[0].Qname)
 	}
 	return err
 }
 
+func (d Database) deleteResolverDnsMessage(resolverId string, qtype uint16, qname string) error {
+	err := d.db.Delete(dnsMessageKey(resolverId, qtype), qname)
+	resetResponseCount(responseCounterKey(resolverId, qtype, qname))
+	resetFaultSequence(responseCounterKey(resolverId, qtype, qname))
+	forgetNamesBelow(resolverId)
+	d.indexExpiry(expiryIndexEntry{ResolverId: resolverId, Qtype: qtype, Qname: qname}, nil)
+	return err
+}
+
 func (d Database) DeleteResolver(resolver Resolver) error {
-	log.Printf("DEBUG Deleting resolver %s\n", resolver.Id)
+	logger.Debug("Deleting resolver", "resolver", resolver.Id)
 	err := d.db.Delete("resolvers", resolver.Id)
+	d.indexExpiry(expiryIndexEntry{ResolverId: resolver.Id}, nil)
 	return err
 }
 
@@ -6,7 +6,6 @@ package yesdns
 // db.go/Database
 import (
 	"github.com/miekg/dns"
-	"log"
 	"net"
 	"time"
 	"errors"
@@ -33,6 +32,8 @@ func appendRR(dnsMsgSection *[]dns.RR, rrSection *DnsRR) error {
 		appendSRV(dnsMsgSection, rrSection)
 	case dns.TypeTXT:
 		appendTXT(dnsMsgSection, rrSection)
+	case dns.TypeDS:
+		appendDS(dnsMsgSection, rrSection)
 	default:
 		return errors.New(fmt.Sprintf("Don't know how to build RR for type %s", rrSection.Type))
 	}
@@ -124,9 +125,22 @@ func appendSRV(dnsMsgSection *[]dns.RR, rrSection *DnsRR) {
 	)
 }
 
+func appendDS(dnsMsgSection *[]dns.RR, rrSection *DnsRR) {
+	rdataMap := rrSection.Rdata.(map[string]interface{})
+	*dnsMsgSection = append(*dnsMsgSection,
+		&dns.DS{
+			Hdr: dns.RR_Header{Name: rrSection.Name, Rrtype: rrSection.Type, Class: rrSection.Class, Ttl: rrSection.Ttl},
+			KeyTag: uint16(rdataMap["key_tag"].(float64)),
+			Algorithm: uint8(rdataMap["algorithm"].(float64)),
+			DigestType: uint8(rdataMap["digest_type"].(float64)),
+			Digest: rdataMap["digest"].(string),
+		},
+	)
+}
+
 func appendTXT(dnsMsgSection *[]dns.RR, rrSection *DnsRR) {
 	// Convert rdata to slice of string
-	txtLines := make([]string, len(rrSection.Rdata.([]interface{})))
+	txtLines := make([]string, 0, len(rrSection.Rdata.([]interface{})))
 	for _, line := range rrSection.Rdata.([]interface{}) {
 		txtLines = append(txtLines, line.(string))
 	}
@@ -138,14 +152,55 @@ func appendTXT(dnsMsgSection *[]dns.RR, rrSection *DnsRR) {
 	)
 }
 
+// The reverse of appendRR. Turns rr into rdata like the REST API takes it.
+func dnsRRFromRR(rr dns.RR) (error, DnsRR) {
+	header := rr.Header()
+	rrSection := DnsRR{Name: header.Name, Type: header.Rrtype, Class: header.Class, Ttl: header.Ttl}
+	switch rr := rr.(type) {
+	case *dns.A:
+		rrSection.Rdata = rr.A.String()
+	case *dns.AAAA:
+		rrSection.Rdata = rr.AAAA.String()
+	case *dns.CNAME:
+		rrSection.Rdata = rr.Target
+	case *dns.MX:
+		rrSection.Rdata = map[string]interface{}{"preference": rr.Preference, "mx": rr.Mx}
+	case *dns.NS:
+		rrSection.Rdata = rr.Ns
+	case *dns.PTR:
+		rrSection.Rdata = rr.Ptr
+	case *dns.SOA:
+		rrSection.Rdata = map[string]interface{}{"ns": rr.Ns, "mbox": rr.Mbox, "serial": rr.Serial,
+			"refresh": rr.Refresh, "retry": rr.Retry, "expire": rr.Expire, "minttl": rr.Minttl}
+	case *dns.SRV:
+		rrSection.Rdata = map[string]interface{}{"priority": rr.Priority, "weight": rr.Weight, "port": rr.Port,
+			"target": rr.Target}
+	case *dns.TXT:
+		var txtLines []interface{}
+		for _, line := range rr.Txt {
+			txtLines = append(txtLines, line)
+		}
+		rrSection.Rdata = txtLines
+	case *dns.DS:
+		rrSection.Rdata = map[string]interface{}{"key_tag": rr.KeyTag, "algorithm": rr.Algorithm,
+			"digest_type": rr.DigestType, "digest": rr.Digest}
+	default:
+		return errors.New(fmt.Sprintf("Don't know how to store RR for type %s", dns.TypeToString[header.Rrtype])), rrSection
+	}
+	return nil, rrSection
+}
+
 // Handles DNS Query operation (OpCode 0)
 // https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-5
-func queryOperation(database *Database, dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, resolver *Resolver) *dns.Msg {
+// Also returns the DnsMessage the response was built from (nil if none was found), and how it was found
+// (see Resolver.Resolve).
+func queryOperation(database *Database, dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, resolver *Resolver) (*dns.Msg, *DnsMessage, string) {
 	queryDomain := requestDnsMsg.Question[0].Name
 	qtype := requestDnsMsg.Question[0].Qtype
 
 	// Try to resolve query and set status
-	err, resolvedDnsMessage := resolver.Resolve(qtype, queryDomain)
+	err, resolvedDnsMessage, answeredBy := resolver.Resolve(qtype, queryDomain, addrIp(dnsResponseWriter.RemoteAddr()),
+		requestEcsIp(requestDnsMsg))
 	if err != nil {
 		// Lookup failed
 		return &dns.Msg{
@@ -159,7 +214,7 @@ func queryOperation(database *Database, dnsResponseWriter dns.ResponseWriter, re
 				Response: true,
 				Authoritative: false,
 			},
-		}
+		}, nil, answeredBy
 	} else if resolvedDnsMessage == nil {
 		// Lookup did not error, but nothing found
 		return &dns.Msg{
@@ -173,7 +228,7 @@ func queryOperation(database *Database, dnsResponseWriter dns.ResponseWriter, re
 				Response: true,
 				Authoritative: false,
 			},
-		}
+		}, nil, answeredBy
 	} // else: lookup did not error and answer found
 
 	returnDnsMsg := &dns.Msg{
@@ -203,78 +258,243 @@ func queryOperation(database *Database, dnsResponseWriter dns.ResponseWriter, re
 	// Build response Answer section
 	for _, rrSection := range resolvedDnsMessage.Answer {
 		if err := appendRR(&returnDnsMsg.Answer, &rrSection); err != nil {
-			log.Printf("WARN Cant build Answer section for type: %s.\n", rrSection.Type)
+			logger.Warn("Cant build Answer section", "type", rrSection.Type, "error", err)
 		}
 	}
+	orderRrsets(returnDnsMsg.Answer, resolvedDnsMessage.RrsetOrder, resolvedDnsMessage.counterKey)
 	// Build response Authority section
 	for _, rrSection := range resolvedDnsMessage.Ns {
 		if err := appendRR(&returnDnsMsg.Ns, &rrSection); err != nil {
-			log.Printf("WARN Cant build Authority section for type: %s.\n", rrSection.Type)
+			logger.Warn("Cant build Authority section", "type", rrSection.Type, "error", err)
 		}
 	}
 	// Build response Extra section
 	for _, rrSection := range resolvedDnsMessage.Extra {
 		if err := appendRR(&returnDnsMsg.Extra, &rrSection); err != nil {
-			log.Printf("WARN Cant build Extra section for type: %s.\n", rrSection.Type)
+			logger.Warn("Cant build Extra section", "type", rrSection.Type, "error", err)
 		}
 	}
 
-	if requestDnsMsg.IsTsig() != nil {
-		if dnsResponseWriter.TsigStatus() == nil {
-			returnDnsMsg.SetTsig(requestDnsMsg.Extra[len(requestDnsMsg.Extra)-1].(*dns.TSIG).Hdr.Name, dns.HmacMD5, 300, time.Now().Unix())
-		} else {
-			log.Println("DEBUG Status", dnsResponseWriter.TsigStatus().Error())
-		}
+	return returnDnsMsg, resolvedDnsMessage, answeredBy
+}
+
+// Writes the response to the client and records it in metrics, the query log and dnstap.
+// fault is one of the Fault* constants, or "" if the response should be written normally.
+func writeResponse(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg,
+	resolver *Resolver, listener ResolverListener, answeredBy string, fault string) {
+	switch fault {
+	case FaultDrop:
+		// Don't respond at all
+	case FaultMalformed:
+		dnsResponseWriter.Write(malformedResponse(responseDnsMsg))
+	default:
+		dnsResponseWriter.WriteMsg(responseDnsMsg)
+		dnstapClientResponse(dnsResponseWriter, responseDnsMsg)
+	}
+	recordResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, answeredBy, fault)
+}
+
+// Records a response in metrics and the query log, whether it was written or not.
+func recordResponse(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg,
+	resolver *Resolver, listener ResolverListener, answeredBy string, fault string) {
+	if fault != "" {
+		metricFaults.Inc(resolver.Id, fault)
+	}
+	recordQuery(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, answeredBy, fault)
+	var qtype uint16
+	if len(requestDnsMsg.Question) > 0 {
+		qtype = requestDnsMsg.Question[0].Qtype
+	}
+	metricQueries.Inc(resolver.Id, listener.Key(), qtypeLabel(qtype), dns.RcodeToString[responseDnsMsg.Rcode])
+}
+
+// Returns the qtype label for a query type. Types we don't know are counted as "other", so that clients can't create
+// a time series for each of the 65536 types.
+func qtypeLabel(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
 	}
-	return returnDnsMsg
+	return "other"
 }
 
 // DNS query handler. Dispatches to operation handlers based on query OpCode.
 // We use a closure to maintain a reference to the database.
-func handleDnsQuery(database *Database, resolver *Resolver) func (dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg) {
+// configuredResolver is only used until SyncServersWithDatabase has registered the latest configuration.
+func handleDnsQuery(database *Database, configuredResolver *Resolver, listener ResolverListener) func (dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg) {
 	return func (dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg) {
 
-		log.Printf("DEBUG Received query for resolver '%s' on local addr %s network %s. Message is: \n%s\n",
-			resolver.Id, dnsResponseWriter.LocalAddr(), dnsResponseWriter.LocalAddr().Network(), requestDnsMsg)
-		
+		resolver := currentResolver(configuredResolver)
+		clientIp := addrIp(dnsResponseWriter.RemoteAddr())
+
+		logger.Debug("Received query", "resolver", resolver.Id, stringerAttr("local_addr", dnsResponseWriter.LocalAddr()),
+			"network", dnsResponseWriter.LocalAddr().Network(), stringerAttr("message", requestDnsMsg))
+		dnstapClientQuery(dnsResponseWriter, requestDnsMsg)
+
+		// Access control
+		if action := resolver.aclAction(listener, clientIp); action != "" {
+			logger.Debug("Query denied by ACL", "resolver", resolver.Id, "listener", listener.Key(),
+				"client", clientIp.String(), "action", action)
+			metricAclDenials.Inc(resolver.Id, listener.Key(), action)
+			responseDnsMsg := new(dns.Msg)
+			responseDnsMsg.SetRcode(requestDnsMsg, dns.RcodeRefused)
+			if action == AclDrop {
+				recordResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, AnsweredByAcl, "")
+			} else {
+				writeResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, AnsweredByAcl, "")
+			}
+			return
+		}
+
+		// Transaction signatures
+		tsigKey, tsigRcode := checkTsig(dnsResponseWriter, requestDnsMsg, resolver, listener)
+		if tsigRcode != dns.RcodeSuccess {
+			responseDnsMsg := new(dns.Msg)
+			responseDnsMsg.SetRcode(requestDnsMsg, tsigRcode)
+			writeResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, AnsweredByNone, "")
+			return
+		}
+
+		// EDNS versions we don't know
+		if unsupportedEdnsVersion(requestDnsMsg) {
+			responseDnsMsg := badVersResponse(requestDnsMsg, resolver.ednsBufferSize())
+			if tsigKey != nil {
+				signResponse(responseDnsMsg, tsigKey)
+			}
+			writeResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, AnsweredByNone, "")
+			return
+		}
+
+		var responseDnsMsg *dns.Msg
+		// DnsMessage from the database that the response was built from, if any
+		var resolvedDnsMessage *DnsMessage
+		answeredBy := AnsweredByNone
+
 		switch requestDnsMsg.Opcode {
 		case dns.OpcodeQuery:
-			// Try to find answer in our internal db
-			log.Printf("DEBUG Trying internal resolution with resolver '%s'\n", resolver.Id)
-			dnsMsg := queryOperation(database, dnsResponseWriter, requestDnsMsg, resolver)
-			log.Printf("DEBUG Internal resolution Rcode is %s\n", dnsMsg.Rcode)
-			if dnsMsg.Rcode == dns.RcodeSuccess {
-				log.Printf("DEBUG Internal resolution succeeded. Responding with message \n%s\n", dnsMsg)
-				dnsResponseWriter.WriteMsg(dnsMsg)
+			if qtype := requestDnsMsg.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+				resolver.transferOut(dnsResponseWriter, requestDnsMsg, listener, tsigKey, clientIp)
 				return
 			}
+			// We are authoritative for names in our zones, so never forward them (see below)
+			zone := resolver.zoneForQuestion(requestDnsMsg.Question[0])
+			if zone != nil && !resolver.zoneServable(*zone) {
+				logger.Debug("Secondary zone not transferred yet or expired", "zone", zone.Apex)
+				responseDnsMsg = new(dns.Msg)
+				responseDnsMsg.SetRcode(requestDnsMsg, dns.RcodeServerFailure)
+				break
+			}
+			// Try to find answer in our internal db
+			logger.Debug("Trying internal resolution", "resolver", resolver.Id)
+			responseDnsMsg, resolvedDnsMessage, answeredBy = queryOperation(database, dnsResponseWriter, requestDnsMsg, resolver)
+			if zone != nil {
+				responseDnsMsg = resolver.zoneResponse(*zone, requestDnsMsg, responseDnsMsg, resolvedDnsMessage != nil,
+					clientIp, requestEcsIp(requestDnsMsg))
+				if resolvedDnsMessage == nil {
+					answeredBy = AnsweredByZone
+				}
+			}
+			// Tell ECS clients which subnets our answer is good for. Only answers from the view picked by ECS are
+			// subnet specific. Answers that fell back to messages without a view are the same for everyone.
+			if subnet := requestEcs(requestDnsMsg); subnet != nil {
+				var scope uint8
+				if view, byEcs := resolver.matchView(clientIp, subnet.Address); byEcs && resolvedDnsMessage != nil &&
+					resolvedDnsMessage.View == view {
+					scope = subnet.SourceNetmask
+				}
+				echoEcs(requestDnsMsg, responseDnsMsg, scope)
+			}
+			logger.Debug("Internal resolution finished", "rcode", dns.RcodeToString[responseDnsMsg.Rcode])
+			if responseDnsMsg.Rcode == dns.RcodeSuccess {
+				logger.Debug("Internal resolution succeeded", stringerAttr("response", responseDnsMsg))
+				break
+			}
+			if zone != nil {
+				logger.Debug("Not forwarding name in zone", "zone", zone.Apex)
+				break
+			}
 			// We did not succeed in internal lookup, so try forwarders
-			log.Printf("DEBUG Trying resolver '%s' forwarders: %s\n", resolver.Id, resolver.Forwarders)
-			err, forwardDnsMsg := resolver.Forward(requestDnsMsg)
+			logger.Debug("Trying forwarders", "resolver", resolver.Id, "forwarders", resolver.Forwarders)
+			err, forwardDnsMsg := resolver.Forward(requestDnsMsg, clientIp)
 			if err == nil && forwardDnsMsg != nil {
 				// Return successful forward resolution
-				log.Printf("DEBUG Forward resolution succeeded with Rcode %s. Responding with message: \n%s\n", forwardDnsMsg.Rcode, forwardDnsMsg)
-				dnsResponseWriter.WriteMsg(forwardDnsMsg)
+				logger.Debug("Forward resolution succeeded", "rcode", dns.RcodeToString[forwardDnsMsg.Rcode], stringerAttr("response", forwardDnsMsg))
+				responseDnsMsg = forwardDnsMsg
+				answeredBy = AnsweredByForwarder
 			} else {
 				// TODO separate log message for nil and not nil forwardDnsMsg
 				// TODO is this correct behavior?
-				// Default to our (failed) internal lookup
-				log.Printf("DEBUG Forward resolution failed. Returning (failed) internal lookup: \n%s\n", dnsMsg)
-				dnsResponseWriter.WriteMsg(dnsMsg)
+				// Default to our (failed) internal lookup. It is still answered by whatever message it came from.
+				logger.Debug("Forward resolution failed. Returning (failed) internal lookup", stringerAttr("response", responseDnsMsg))
 			}
+		case dns.OpcodeNotify:
+			resolver.notifyIn(dnsResponseWriter, requestDnsMsg, listener, tsigKey, clientIp)
+			return
+		case dns.OpcodeUpdate:
+			resolver.updateIn(dnsResponseWriter, requestDnsMsg, listener, tsigKey, clientIp)
+			return
 		default:
-			log.Printf("WARN Opcode %s not supported\n", requestDnsMsg.Opcode)
+			logger.Warn("Opcode not supported", "opcode", dns.OpcodeToString[requestDnsMsg.Opcode])
 			// Return a failure message
-			dnsMsg := new(dns.Msg)
-			dnsMsg.Rcode = dns.RcodeNotImplemented
-			dnsMsg.Id = requestDnsMsg.Id
-			dnsMsg.RecursionDesired = requestDnsMsg.RecursionDesired // Copy rd bit
-			dnsMsg.Response = true
-			dnsMsg.Opcode = requestDnsMsg.Opcode
-			dnsMsg.RecursionAvailable = false
-			dnsResponseWriter.WriteMsg(dnsMsg)
+			responseDnsMsg = new(dns.Msg)
+			responseDnsMsg.Rcode = dns.RcodeNotImplemented
+			responseDnsMsg.Id = requestDnsMsg.Id
+			responseDnsMsg.RecursionDesired = requestDnsMsg.RecursionDesired // Copy rd bit
+			responseDnsMsg.Response = true
+			responseDnsMsg.Opcode = requestDnsMsg.Opcode
+			responseDnsMsg.RecursionAvailable = false
+		}
+
+		// EDNS0 and UDP size limit
+		echoOpt(requestDnsMsg, responseDnsMsg, resolver.ednsBufferSize())
+		truncateResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver.ednsBufferSize(), tsigKey)
+
+		// Response rate limiting
+		if limited := rateLimit(resolver, dnsResponseWriter, requestDnsMsg, responseDnsMsg); limited != RrlPass {
+			logger.Debug("Response rate limited", "resolver", resolver.Id, "client", clientIp.String(), "action", limited)
+			metricRateLimited.Inc(resolver.Id, limited)
+			if limited == RrlDrop {
+				recordResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, answeredBy, "")
+				return
+			}
+			responseDnsMsg = slipResponse(requestDnsMsg, responseDnsMsg)
+		}
+
+		// Simulate a misbehaving server
+		var fault string
+		if len(requestDnsMsg.Question) > 0 {
+			if fault = responseFault(resolver, resolvedDnsMessage); fault != "" {
+				logger.Debug("Injecting fault", "fault", fault)
+				responseDnsMsg = applyFault(fault, requestDnsMsg, responseDnsMsg)
+			}
+		}
+
+		// Simulate a slow server
+		if delay := responseDelay(resolver, resolvedDnsMessage); delay > 0 {
+			logger.Debug("Delaying response", "delay", delay)
+			time.Sleep(delay)
+		}
+
+		// Sign the response with the key the query was signed with
+		if tsigKey != nil {
+			signResponse(responseDnsMsg, tsigKey)
 		}
+
+		writeResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, resolver, listener, answeredBy, fault)
+	}
+}
+
+// Like dns.DefaultMsgAcceptFunc, but also accepts UPDATE requests, whose sections can hold any number of RRs
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if !isResponse && opcode == dns.OpcodeUpdate {
+		// The zone section
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
 	}
+	return dns.DefaultMsgAcceptFunc(dh)
 }
 
 // Runs DNS server forever.
@@ -283,25 +503,17 @@ func handleDnsQuery(database *Database, resolver *Resolver) func (dnsResponseWri
 //
 // net: (string) "tcp" or "udp"
 // listenAddr: (string) ip addr and port to listen on
-// name: (string) DNSSEC  name.
-// secret: (string) DNSSEC TSIG.
-func serveDns(net, listenAddr, name, secret string, handler dns.Handler, shutdownChannel chan int) {
-	log.Printf("DEBUG Starting DNS listener on %s %s\n", net, listenAddr)
-
-	var server *dns.Server
+// tsigProvider: (dns.TsigProvider) Verifies and signs TSIG.
+func serveDns(net, listenAddr string, tsigProvider dns.TsigProvider, handler dns.Handler, shutdownChannel chan int) {
+	logger.Debug("Starting DNS listener", "net", net, "address", listenAddr)
 
-	// Support for TSIG
-	switch name {
-	case "":
-		server = &dns.Server{Addr: listenAddr, Net: net, TsigSecret: nil, Handler: handler}
-	default:
-		server = &dns.Server{Addr: listenAddr, Net: net, TsigSecret: map[string]string{name: secret}, Handler: handler}
-	}
+	server := &dns.Server{Addr: listenAddr, Net: net, TsigProvider: tsigProvider, Handler: handler,
+		MsgAcceptFunc: acceptMsg}
 
 	// Start this up in an anonymous goroutine because server.ListenAndServe() blocks
 	go func() {
 		if err := server.ListenAndServe(); err != nil {
-			log.Printf("DEBUG Closed " + net + " server: %s\n", err.Error())
+			logger.Debug("Closed DNS listener", "net", net, "address", listenAddr, "error", err)
 		}
 	}()
 
@@ -0,0 +1,245 @@
+package yesdns
+
+// Online DNSSEC signing of zones (see zone.go).
+// Every signed zone has one combined signing key (CSK). RRsets are signed when they are served to clients that set
+// the DO bit. Nonexistence is proven on the fly as well, so there is no need to walk the whole zone.
+
+import (
+	"crypto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Values for ZoneDnssec.Denial
+const (
+	// Compact denial of existence (RFC 9824). NXDOMAIN is answered as NOERROR with a single NSEC. The default.
+	DenialBlackLies = "black_lies"
+	// Minimally covering NSEC records (RFC 4470) that keep the NXDOMAIN rcode
+	DenialNsec = "nsec"
+)
+
+// Type code of NXNAME (RFC 9824), which tells validators that a black lies NSEC stands for NXDOMAIN
+const typeNxname = 128
+
+// Signatures are valid from an hour ago, to allow for clock skew, until a week from now
+const (
+	rrsigInceptionOffset  = -1 * time.Hour
+	rrsigExpirationOffset = 7 * 24 * time.Hour
+)
+
+type ZoneDnssec struct {
+	// How nonexistence is proven. One of black_lies (default) or nsec.
+	Denial string `json:"denial,omitempty"`
+}
+
+// True if the client wants DNSSEC records
+func dnssecOk(requestDnsMsg *dns.Msg) bool {
+	opt := requestDnsMsg.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// Parsed signing key of a zone
+type zoneKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// Returns the signing key of zone, or nil if the zone is not signed or has no key.
+func (r Resolver) zoneKey(zone Zone) *zoneKey {
+	if zone.Dnssec == nil {
+		return nil
+	}
+	key := r.Database.loadZoneKey(r.Id, zone.canonicalApex())
+	if key == nil {
+		logger.Warn("DNSSEC enabled but zone has no key", "resolver", r.Id, "zone", zone.Apex)
+	}
+	return key
+}
+
+func (k zoneKey) dnskeyRR() dns.RR {
+	return dns.Copy(k.dnskey)
+}
+
+// Appends an RRSIG for every RRset in rrs that belongs to zone. RRsets are RRs with the same name, type and class.
+func (k zoneKey) signSection(rrs *[]dns.RR, zone Zone) {
+	var rrsetKeys []string
+	rrsets := make(map[string][]dns.RR)
+	for _, rr := range *rrs {
+		header := rr.Header()
+		switch header.Rrtype {
+		case dns.TypeRRSIG, dns.TypeOPT, dns.TypeTSIG:
+			continue
+		}
+		if !zone.Contains(header.Name) {
+			continue
+		}
+		// NS records below the apex are delegations, which belong to the child zone and are not signed
+		if header.Rrtype == dns.TypeNS && dns.CanonicalName(header.Name) != zone.canonicalApex() {
+			continue
+		}
+		rrsetKey := strings.ToLower(header.Name) + "/" + dns.Type(header.Rrtype).String() + "/" + dns.Class(header.Class).String()
+		if _, ok := rrsets[rrsetKey]; !ok {
+			rrsetKeys = append(rrsetKeys, rrsetKey)
+		}
+		rrsets[rrsetKey] = append(rrsets[rrsetKey], rr)
+	}
+	now := time.Now()
+	for _, rrsetKey := range rrsetKeys {
+		rrset := rrsets[rrsetKey]
+		rrsig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: rrset[0].Header().Class, Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.dnskey.Algorithm,
+			Inception:  uint32(now.Add(rrsigInceptionOffset).Unix()),
+			Expiration: uint32(now.Add(rrsigExpirationOffset).Unix()),
+			KeyTag:     k.dnskey.KeyTag(),
+			SignerName: k.dnskey.Hdr.Name,
+		}
+		if err := rrsig.Sign(k.signer, rrset); err != nil {
+			logger.Warn("Could not sign RRset", "rrset", rrsetKey, "error", err)
+			continue
+		}
+		*rrs = append(*rrs, rrsig)
+	}
+}
+
+// Returns the NSEC records that prove that name has none of the queried type (if qtypes, the types it has, is not
+// empty) or doesn't exist at all. May change the rcode of negativeDnsMsg.
+func (z Zone) denial(name string, qtypes []uint16, negativeDnsMsg *dns.Msg, ttl uint32) []dns.RR {
+	if dns.CanonicalName(name) == z.canonicalApex() {
+		qtypes = append(qtypes, dns.TypeSOA, dns.TypeDNSKEY)
+	}
+	if negativeDnsMsg.Rcode != dns.RcodeNameError {
+		// NODATA: the name exists, just not with this type. The next name is the first possible name below it, so
+		// the NSEC doesn't deny names below it, which exist if name is an empty non-terminal.
+		return []dns.RR{newNsec(name, "\\000."+dns.Fqdn(name), ttl, append(qtypes, dns.TypeRRSIG, dns.TypeNSEC))}
+	}
+	if z.Dnssec.Denial != DenialNsec {
+		negativeDnsMsg.Rcode = dns.RcodeSuccess
+		return []dns.RR{newNsec(name, successorName(name), ttl, []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNxname})}
+	}
+	// NXDOMAIN: one NSEC covers name, which makes its parent the closest encloser, and one covers the wildcard
+	// at the closest encloser
+	wildcard := "*." + parentName(name)
+	return []dns.RR{
+		newNsec(predecessorName(name), successorName(name), ttl, []uint16{dns.TypeRRSIG, dns.TypeNSEC}),
+		newNsec(predecessorName(wildcard), successorName(wildcard), ttl, []uint16{dns.TypeRRSIG, dns.TypeNSEC}),
+	}
+}
+
+// Returns the NSEC records that prove that name doesn't exist, and that the wildcard that would match it only has
+// wildcardQtypes, not the queried type
+func (z Zone) wildcardDenial(name string, wildcardQtypes []uint16, ttl uint32) []dns.RR {
+	if z.Dnssec.Denial != DenialNsec {
+		// Black lies pretend that name exists, so name is just NODATA
+		return []dns.RR{newNsec(name, "\\000."+dns.Fqdn(name), ttl, append(wildcardQtypes, dns.TypeRRSIG, dns.TypeNSEC))}
+	}
+	// One NSEC covers name, so there is no exact match, and one at the wildcard lacks the type (RFC 4035 section 3.1.3.4)
+	wildcard := qnameToWildcard(dns.Fqdn(name))
+	return []dns.RR{
+		newNsec(predecessorName(name), successorName(name), ttl, []uint16{dns.TypeRRSIG, dns.TypeNSEC}),
+		newNsec(wildcard, "\\000."+wildcard, ttl, append(wildcardQtypes, dns.TypeRRSIG, dns.TypeNSEC)),
+	}
+}
+
+func newNsec(name string, nextDomain string, ttl uint32, types []uint16) *dns.NSEC {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	var typeBitMap []uint16
+	for i, t := range types {
+		if i == 0 || t != types[i-1] {
+			typeBitMap = append(typeBitMap, t)
+		}
+	}
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: nextDomain,
+		TypeBitMap: typeBitMap,
+	}
+}
+
+func parentName(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) <= 1 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[1:], "."))
+}
+
+// A name that sorts right after name and all names below it, in the canonical order of RFC 4034 section 6.1.
+// Made by appending a zero octet to the first label.
+func successorName(name string) string {
+	labels := dns.SplitDomainName(name)
+	first := unescapeLabel(labels[0])
+	if len(first) < 63 {
+		first = append(first, 0)
+	}
+	return dns.Fqdn(strings.Join(append([]string{escapeLabel(first)}, labels[1:]...), "."))
+}
+
+// A name that sorts shortly before name, in the canonical order of RFC 4034 section 6.1, and has the same parent.
+// Made by decrementing the last octet of the first label and appending the largest octet.
+func predecessorName(name string) string {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	first := unescapeLabel(labels[0])
+	last := len(first) - 1
+	if first[last] == 0 {
+		first = first[:last]
+	} else {
+		first[last]--
+		// Uppercase letters sort as lowercase, so skip past them
+		if first[last] >= 'A' && first[last] <= 'Z' {
+			first[last] = 'A' - 1
+		}
+		if len(first) < 63 {
+			first = append(first, 255)
+		}
+	}
+	if len(first) == 0 {
+		// There is nothing shorter than a single zero octet, so fall back to the parent
+		return parentName(name)
+	}
+	return dns.Fqdn(strings.Join(append([]string{escapeLabel(first)}, labels[1:]...), "."))
+}
+
+// Turns a label in presentation format into its octets
+func unescapeLabel(label string) []byte {
+	var octets []byte
+	for i := 0; i < len(label); i++ {
+		if label[i] == '\\' && i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+			octets = append(octets, (label[i+1]-'0')*100+(label[i+2]-'0')*10+(label[i+3]-'0'))
+			i += 3
+		} else if label[i] == '\\' && i+1 < len(label) {
+			octets = append(octets, label[i+1])
+			i++
+		} else {
+			octets = append(octets, label[i])
+		}
+	}
+	return octets
+}
+
+// Turns the octets of a label into presentation format
+func escapeLabel(octets []byte) string {
+	var label strings.Builder
+	for _, octet := range octets {
+		switch {
+		case octet == '.' || octet == '\\' || octet == '"' || octet == '(' || octet == ')' || octet == ';' || octet == '@' || octet == '$':
+			label.WriteByte('\\')
+			label.WriteByte(octet)
+		case octet < '!' || octet > '~':
+			label.WriteString("\\")
+			label.WriteByte('0' + octet/100)
+			label.WriteByte('0' + octet/10%10)
+			label.WriteByte('0' + octet%10)
+		default:
+			label.WriteByte(octet)
+		}
+	}
+	return label.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,281 @@
+package yesdns
+
+// DNSSEC signing keys managed via /v1/dnssec-keys and stored in the Database. Keys are generated by YesDNS or
+// uploaded in the format of BIND's dnssec-keygen. Private keys are never returned by the API.
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const dnssecKeysCollection = "dnssec-keys"
+
+// Algorithm used to generate keys if none is given
+const DefaultDnssecAlgorithm = "ECDSAP256SHA256"
+
+// Key sizes in bits for the algorithms we can generate keys for
+var dnssecKeyBits = map[uint8]int{
+	dns.RSASHA256:       2048,
+	dns.ECDSAP256SHA256: 256,
+	dns.ECDSAP384SHA384: 384,
+	dns.ED25519:         256,
+}
+
+// A zone signing key as stored in the Database, and as uploaded via PUT /v1/dnssec-keys.
+type DnssecKey struct {
+	Resolver string `json:"resolver"`
+	Zone     string `json:"zone"`
+	// Only used when generating a key. e.g. ECDSAP256SHA256 or ED25519.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Presentation format, like the .key file of dnssec-keygen. Leave empty to generate a key.
+	Dnskey string `json:"dnskey,omitempty"`
+	// Like the .private file of dnssec-keygen
+	PrivateKey string `json:"private_key,omitempty"`
+}
+
+// What /v1/dnssec-keys returns. Never includes the private key.
+type DnssecKeyInfo struct {
+	Resolver  string `json:"resolver"`
+	Zone      string `json:"zone"`
+	Algorithm string `json:"algorithm"`
+	KeyTag    uint16 `json:"key_tag"`
+	Dnskey    string `json:"dnskey"`
+	// To put in the parent zone, or to use as a trust anchor
+	Ds string `json:"ds"`
+}
+
+// Parsed keys by zoneResource, so we don't parse them on every query. nil means no key.
+var zoneKeys = struct {
+	sync.RWMutex
+	byResource map[string]*zoneKey
+}{byResource: make(map[string]*zoneKey)}
+
+func (key DnssecKey) parse() (error, *zoneKey) {
+	rr, err := dns.NewRR(key.Dnskey)
+	if err != nil {
+		return err, nil
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return errors.New(fmt.Sprintf("Not a DNSKEY: %s", key.Dnskey)), nil
+	}
+	if dns.CanonicalName(dnskey.Hdr.Name) != dns.CanonicalName(key.Zone) {
+		return errors.New(fmt.Sprintf("DNSKEY owner %s is not zone %s", dnskey.Hdr.Name, key.Zone)), nil
+	}
+	privateKey, err := dnskey.ReadPrivateKey(strings.NewReader(key.PrivateKey), "private_key")
+	if err != nil {
+		return err, nil
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("Private key can't sign"), nil
+	}
+	return nil, &zoneKey{dnskey: dnskey, signer: signer}
+}
+
+func (key zoneKey) info(resolverId string, zone string) DnssecKeyInfo {
+	return DnssecKeyInfo{
+		Resolver:  resolverId,
+		Zone:      dns.CanonicalName(zone),
+		Algorithm: dns.AlgorithmToString[key.dnskey.Algorithm],
+		KeyTag:    key.dnskey.KeyTag(),
+		Dnskey:    key.dnskey.String(),
+		Ds:        key.dnskey.ToDS(dns.SHA256).String(),
+	}
+}
+
+// Generates a key pair for the zone of key, using key.Algorithm
+func (key *DnssecKey) generate() error {
+	algorithmName := key.Algorithm
+	if algorithmName == "" {
+		algorithmName = DefaultDnssecAlgorithm
+	}
+	algorithm, ok := dns.StringToAlgorithm[strings.ToUpper(algorithmName)]
+	bits, supported := dnssecKeyBits[algorithm]
+	if !ok || !supported {
+		return errors.New(fmt.Sprintf("Can't generate keys for algorithm %s", algorithmName))
+	}
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(key.Zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		// Zone key and secure entry point, ie. a combined signing key
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	privateKey, err := dnskey.Generate(bits)
+	if err != nil {
+		return err
+	}
+	key.Dnskey = dnskey.String()
+	key.PrivateKey = dnskey.PrivateKeyString(privateKey)
+	return nil
+}
+
+func (d Database) WriteDnssecKey(key DnssecKey) error {
+	err := d.db.Write(dnssecKeysCollection, zoneResource(key.Resolver, key.Zone), key)
+	forgetZoneKey(key.Resolver, key.Zone)
+	return err
+}
+
+func (d Database) DeleteDnssecKey(key DnssecKey) error {
+	err := d.db.Delete(dnssecKeysCollection, zoneResource(key.Resolver, key.Zone))
+	forgetZoneKey(key.Resolver, key.Zone)
+	return err
+}
+
+func (d Database) ReadAllDnssecKeys() (error, []DnssecKey) {
+	jsonStrings, err := d.db.ReadAll(dnssecKeysCollection)
+	if err != nil {
+		return err, nil
+	}
+	var keys []DnssecKey
+	for _, jsonString := range jsonStrings {
+		var key DnssecKey
+		if err := json.NewDecoder(bytes.NewBufferString(jsonString)).Decode(&key); err != nil {
+			logger.Warn("Could not decode DNSSEC key", "error", err)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return nil, keys
+}
+
+func forgetZoneKey(resolverId string, zone string) {
+	zoneKeys.Lock()
+	delete(zoneKeys.byResource, zoneResource(resolverId, zone))
+	zoneKeys.Unlock()
+}
+
+// Returns the parsed signing key of zone in resolverId, or nil if there is none
+func (d Database) loadZoneKey(resolverId string, zone string) *zoneKey {
+	resource := zoneResource(resolverId, zone)
+	zoneKeys.RLock()
+	key, ok := zoneKeys.byResource[resource]
+	zoneKeys.RUnlock()
+	if ok {
+		return key
+	}
+	var dnssecKey DnssecKey
+	if err := d.db.Read(dnssecKeysCollection, resource, &dnssecKey); err == nil {
+		if err, key = dnssecKey.parse(); err != nil {
+			logger.Warn("Could not parse DNSSEC key", "resolver", resolverId, "zone", zone, "error", err)
+		}
+	}
+	zoneKeys.Lock()
+	zoneKeys.byResource[resource] = key
+	zoneKeys.Unlock()
+	return key
+}
+
+// Handles /v1/dnssec-keys
+//
+// GET lists the public parts of all keys, optionally filtered by the resolver and zone query parameters.
+// PUT generates a key for the resolver and zone in the body, or stores the uploaded dnskey and private_key.
+// Responds with the public parts of the key.
+// DELETE deletes the key of the resolver and zone in the body.
+func serveDnssecKeys(database *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// We get err if there are no keys yet, which is not an error
+			_, keys := database.ReadAllDnssecKeys()
+			infos := []DnssecKeyInfo{}
+			for _, key := range keys {
+				if resolverId := r.URL.Query().Get("resolver"); resolverId != "" && resolverId != key.Resolver {
+					continue
+				}
+				if zone := r.URL.Query().Get("zone"); zone != "" && dns.CanonicalName(zone) != dns.CanonicalName(key.Zone) {
+					continue
+				}
+				// Only show keys of resolvers the client may write to
+				if !authorizedForResolvers(r, key.Resolver) {
+					continue
+				}
+				if err, _ := authorizeDnsMessageWrite(r, database, []string{key.Resolver}); err != nil {
+					continue
+				}
+				if err, parsed := key.parse(); err == nil {
+					infos = append(infos, parsed.info(key.Resolver, key.Zone))
+				}
+			}
+			sort.Slice(infos, func(i, j int) bool {
+				return infos[i].Resolver+" "+infos[i].Zone < infos[j].Resolver+" "+infos[j].Zone
+			})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(infos)
+			return
+		}
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			http.Error(w, fmt.Sprintf("Method %s not allowed for /v1/dnssec-keys\n", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Body == nil {
+			http.Error(w, "Empty body not allowed", http.StatusBadRequest)
+			return
+		}
+		var key DnssecKey
+		if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+			logger.Warn("Could not decode DNSSEC key", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key.Resolver == "" || key.Zone == "" {
+			http.Error(w, "resolver and zone are required", http.StatusBadRequest)
+			return
+		}
+		if err := validateResolverId(key.Resolver); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateZoneName(key.Zone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !authorizedForResolvers(r, key.Resolver) {
+			http.Error(w, fmt.Sprintf("Not allowed to write to resolver %s\n", key.Resolver), http.StatusForbidden)
+			return
+		}
+		if err, status := authorizeDnsMessageWrite(r, database, []string{key.Resolver}); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if err := database.DeleteDnssecKey(key); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			logger.Info("Deleted DNSSEC key", "resolver", key.Resolver, "zone", key.Zone)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if key.Dnskey == "" {
+			if err := key.generate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		err, parsed := key.parse()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key.Algorithm = dns.AlgorithmToString[parsed.dnskey.Algorithm]
+		if err := database.WriteDnssecKey(key); err != nil {
+			logger.Error("Error writing DNSSEC key", "resolver", key.Resolver, "zone", key.Zone, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info := parsed.info(key.Resolver, key.Zone)
+		logger.Info("Saved DNSSEC key", "resolver", key.Resolver, "zone", info.Zone, "key_tag", info.KeyTag)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
@@ -0,0 +1,173 @@
+package yesdns
+
+// Optional dnstap (frame stream protobuf) logging of client and forwarder queries and responses.
+// http://dnstap.info/
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// nil when dnstap is disabled
+var dnstapOutput dnstap.Output
+
+var dnstapIdentity []byte
+
+var dnstapVersion = []byte("yesdns")
+
+// Starts writing dnstap messages to target.
+// target is either unix:///path/to/socket for a Unix socket, or the name of a file.
+func StartDnstap(target string) error {
+	var output dnstap.Output
+	if strings.HasPrefix(target, "unix://") {
+		addr, err := net.ResolveUnixAddr("unix", strings.TrimPrefix(target, "unix://"))
+		if err != nil {
+			return err
+		}
+		if output, err = dnstap.NewFrameStreamSockOutput(addr); err != nil {
+			return err
+		}
+	} else {
+		fileOutput, err := dnstap.NewFrameStreamOutputFromFilename(target)
+		if err != nil {
+			return err
+		}
+		output = fileOutput
+	}
+	go output.RunOutputLoop()
+	if hostname, err := os.Hostname(); err == nil {
+		dnstapIdentity = []byte(hostname)
+	}
+	dnstapOutput = output
+	logger.Info("Writing dnstap messages", "target", target)
+	return nil
+}
+
+// Flushes and closes the dnstap output, if any.
+func StopDnstap() {
+	if dnstapOutput != nil {
+		dnstapOutput.Close()
+	}
+}
+
+// Logs a query received from a client
+func dnstapClientQuery(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg) {
+	if dnstapOutput == nil {
+		return
+	}
+	message := &dnstap.Message{Type: dnstap.Message_CLIENT_QUERY.Enum()}
+	setDnstapAddrs(message, dnsResponseWriter.RemoteAddr(), dnsResponseWriter.LocalAddr())
+	message.QueryTimeSec, message.QueryTimeNsec = dnstapTime(time.Now())
+	message.QueryMessage, _ = requestDnsMsg.Pack()
+	sendDnstap(message)
+}
+
+// Logs a response sent to a client
+func dnstapClientResponse(dnsResponseWriter dns.ResponseWriter, responseDnsMsg *dns.Msg) {
+	if dnstapOutput == nil {
+		return
+	}
+	message := &dnstap.Message{Type: dnstap.Message_CLIENT_RESPONSE.Enum()}
+	setDnstapAddrs(message, dnsResponseWriter.RemoteAddr(), dnsResponseWriter.LocalAddr())
+	message.ResponseTimeSec, message.ResponseTimeNsec = dnstapTime(time.Now())
+	message.ResponseMessage, _ = responseDnsMsg.Pack()
+	sendDnstap(message)
+}
+
+// Logs a query sent to a forwarder and, if there was one, its response.
+func dnstapForwarder(forwarder Forwarder, queryTime time.Time, dnsMsg *dns.Msg, responseDnsMsg *dns.Msg) {
+	if dnstapOutput == nil {
+		return
+	}
+	// Forwarders given by host name are logged without address. Looking them up again just for dnstap is not worth it.
+	var forwarderAddr net.Addr
+	if host, port, err := net.SplitHostPort(forwarder.Address); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			portNumber, _ := strconv.Atoi(port)
+			if forwarder.Net == "tcp" {
+				forwarderAddr = &net.TCPAddr{IP: ip, Port: portNumber}
+			} else {
+				forwarderAddr = &net.UDPAddr{IP: ip, Port: portNumber}
+			}
+		}
+	}
+
+	query := &dnstap.Message{Type: dnstap.Message_FORWARDER_QUERY.Enum()}
+	setDnstapAddrs(query, nil, forwarderAddr)
+	query.QueryTimeSec, query.QueryTimeNsec = dnstapTime(queryTime)
+	query.QueryMessage, _ = dnsMsg.Pack()
+	sendDnstap(query)
+
+	if responseDnsMsg == nil {
+		return
+	}
+	response := &dnstap.Message{Type: dnstap.Message_FORWARDER_RESPONSE.Enum()}
+	setDnstapAddrs(response, nil, forwarderAddr)
+	response.QueryTimeSec, response.QueryTimeNsec = query.QueryTimeSec, query.QueryTimeNsec
+	response.ResponseTimeSec, response.ResponseTimeNsec = dnstapTime(time.Now())
+	response.ResponseMessage, _ = responseDnsMsg.Pack()
+	sendDnstap(response)
+}
+
+// Sets socket family, protocol, addresses and ports.
+// queryAddr is the initiator of the query, responseAddr is the responder.
+func setDnstapAddrs(message *dnstap.Message, queryAddr net.Addr, responseAddr net.Addr) {
+	for i, addr := range []net.Addr{queryAddr, responseAddr} {
+		var ip net.IP
+		var port int
+		switch a := addr.(type) {
+		case *net.UDPAddr:
+			ip, port = a.IP, a.Port
+			message.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+		case *net.TCPAddr:
+			ip, port = a.IP, a.Port
+			message.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+		default:
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			message.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		} else {
+			message.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		}
+		dnstapPort := uint32(port)
+		if i == 0 {
+			message.QueryAddress, message.QueryPort = ip, &dnstapPort
+		} else {
+			message.ResponseAddress, message.ResponsePort = ip, &dnstapPort
+		}
+	}
+}
+
+func dnstapTime(t time.Time) (*uint64, *uint32) {
+	sec := uint64(t.Unix())
+	nsec := uint32(t.Nanosecond())
+	return &sec, &nsec
+}
+
+// Never blocks. Messages are dropped if the output can not keep up.
+func sendDnstap(message *dnstap.Message) {
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: dnstapIdentity,
+		Version:  dnstapVersion,
+		Message:  message,
+	})
+	if err != nil {
+		logger.Warn("Could not marshal dnstap message", "error", err)
+		return
+	}
+	select {
+	case dnstapOutput.GetOutputChannel() <- frame:
+	default:
+		logger.Debug("Dropped dnstap message because output is busy")
+	}
+}
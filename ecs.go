@@ -0,0 +1,144 @@
+package yesdns
+
+// EDNS Client Subnet (RFC 7871).
+// https://tools.ietf.org/html/rfc7871
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Values for Resolver.ForwardEcs
+const (
+	// Forward ECS exactly as received from the client. The default.
+	ForwardEcsPassthrough = "passthrough"
+	// Remove ECS before forwarding
+	ForwardEcsStrip = "strip"
+	// Add the client's subnet if the query has no ECS
+	ForwardEcsAdd = "add"
+)
+
+// Source prefix lengths used when we add ECS ourselves. These are the defaults recommended by RFC 7871 section 11.1.
+const (
+	ecsSourceNetmask4 = 24
+	ecsSourceNetmask6 = 56
+)
+
+// Returns the ECS option of msg, or nil if it has none.
+func requestEcs(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the address of the ECS option of msg, or nil if it has none.
+func requestEcsIp(msg *dns.Msg) net.IP {
+	if subnet := requestEcs(msg); subnet != nil {
+		return subnet.Address
+	}
+	return nil
+}
+
+// Removes ECS from the OPT record of msg, if there is one.
+func removeEcs(msg *dns.Msg) {
+	if opt := msg.IsEdns0(); opt != nil {
+		var options []dns.EDNS0
+		for _, option := range opt.Option {
+			if _, ok := option.(*dns.EDNS0_SUBNET); !ok {
+				options = append(options, option)
+			}
+		}
+		opt.Option = options
+	}
+}
+
+// Returns the OPT record of msg, adding one if there is none.
+func ensureOpt(msg *dns.Msg) *dns.OPT {
+	if opt := msg.IsEdns0(); opt != nil {
+		return opt
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	msg.Extra = append(msg.Extra, opt)
+	return opt
+}
+
+// Copies the client's ECS option into responseDnsMsg with the given scope prefix length.
+// A scope of 0 tells the client that the answer is valid for any subnet.
+func echoEcs(requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg, scope uint8) {
+	subnet := requestEcs(requestDnsMsg)
+	if subnet == nil {
+		return
+	}
+	removeEcs(responseDnsMsg)
+	opt := ensureOpt(responseDnsMsg)
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        subnet.Family,
+		SourceNetmask: subnet.SourceNetmask,
+		SourceScope:   scope,
+		Address:       subnet.Address,
+	})
+}
+
+// Returns the message to send to forwarders according to Resolver.ForwardEcs, and a function that undoes
+// our changes in the forwarder's response, so that the client gets back what it asked for.
+func forwardEcs(mode string, dnsMsg *dns.Msg, clientIp net.IP) (*dns.Msg, func(responseDnsMsg *dns.Msg)) {
+	hadOpt := dnsMsg.IsEdns0() != nil
+	hadEcs := requestEcs(dnsMsg) != nil
+	undo := func(responseDnsMsg *dns.Msg) {
+		if responseDnsMsg == nil {
+			return
+		}
+		if !hadOpt {
+			removeOpt(responseDnsMsg)
+		} else if !hadEcs {
+			removeEcs(responseDnsMsg)
+		}
+	}
+	switch mode {
+	case ForwardEcsStrip:
+		if !hadEcs {
+			break
+		}
+		forwardDnsMsg := dnsMsg.Copy()
+		removeEcs(forwardDnsMsg)
+		return forwardDnsMsg, undo
+	case ForwardEcsAdd:
+		if hadEcs || clientIp == nil {
+			break
+		}
+		forwardDnsMsg := dnsMsg.Copy()
+		subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+		if ip4 := clientIp.To4(); ip4 != nil {
+			subnet.Family = 1
+			subnet.SourceNetmask = ecsSourceNetmask4
+			subnet.Address = ip4.Mask(net.CIDRMask(ecsSourceNetmask4, 32))
+		} else {
+			subnet.Family = 2
+			subnet.SourceNetmask = ecsSourceNetmask6
+			subnet.Address = clientIp.Mask(net.CIDRMask(ecsSourceNetmask6, 128))
+		}
+		opt := ensureOpt(forwardDnsMsg)
+		opt.Option = append(opt.Option, subnet)
+		return forwardDnsMsg, undo
+	}
+	return dnsMsg, func(responseDnsMsg *dns.Msg) {}
+}
+
+// Removes the OPT record from msg
+func removeOpt(msg *dns.Msg) {
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
@@ -0,0 +1,74 @@
+package yesdns
+
+// EDNS0 (RFC 6891) and UDP truncation.
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// UDP payload size we advertise if Resolver.EdnsBufferSize is not set. Recommended by DNS Flag Day 2020.
+const DefaultEdnsBufferSize = 1232
+
+func (r Resolver) ednsBufferSize() uint16 {
+	if r.EdnsBufferSize == 0 {
+		return DefaultEdnsBufferSize
+	}
+	return r.EdnsBufferSize
+}
+
+// Makes the OPT record of responseDnsMsg match the request. Clients that sent OPT get one back advertising
+// bufferSize, with the DO bit copied from the request. Clients that didn't send OPT must not get one.
+func echoOpt(requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg, bufferSize uint16) {
+	requestOpt := requestDnsMsg.IsEdns0()
+	if requestOpt == nil {
+		removeOpt(responseDnsMsg)
+		return
+	}
+	opt := ensureOpt(responseDnsMsg)
+	opt.SetUDPSize(bufferSize)
+	opt.SetDo(requestOpt.Do())
+}
+
+// Largest UDP response the client can take: the size it advertised in OPT, or 512 bytes without OPT.
+// Never more than bufferSize, the size we advertise ourselves.
+func udpResponseSize(requestDnsMsg *dns.Msg, bufferSize uint16) int {
+	size := dns.MinMsgSize
+	if opt := requestDnsMsg.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if int(bufferSize) > dns.MinMsgSize && size > int(bufferSize) {
+		size = int(bufferSize)
+	}
+	return size
+}
+
+// Truncates responseDnsMsg and sets TC if it is too big for the client over UDP. TCP responses are left alone.
+// If the response is going to be signed with tsigKey, room is left for the TSIG RR. tsigKey may be nil.
+func truncateResponse(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg,
+	bufferSize uint16, tsigKey *TsigKey) {
+	if _, ok := dnsResponseWriter.RemoteAddr().(*net.UDPAddr); !ok {
+		return
+	}
+	size := udpResponseSize(requestDnsMsg, bufferSize)
+	if tsigKey != nil {
+		size -= tsigKey.rrSize()
+	}
+	responseDnsMsg.Truncate(size)
+}
+
+// True if the request has an OPT RR of an EDNS version other than 0, the only one there is
+func unsupportedEdnsVersion(requestDnsMsg *dns.Msg) bool {
+	opt := requestDnsMsg.IsEdns0()
+	return opt != nil && opt.Version() != 0
+}
+
+// Response to a request with an unsupported EDNS version. Has our OPT RR, which tells the client the version we
+// support (RFC 6891 section 6.1.3).
+func badVersResponse(requestDnsMsg *dns.Msg, bufferSize uint16) *dns.Msg {
+	responseDnsMsg := new(dns.Msg)
+	responseDnsMsg.SetRcode(requestDnsMsg, dns.RcodeBadVers)
+	echoOpt(requestDnsMsg, responseDnsMsg, bufferSize)
+	return responseDnsMsg
+}
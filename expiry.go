@@ -0,0 +1,172 @@
+package yesdns
+
+// Time-limited DnsMessages and Resolvers.
+// Expired records are no longer served, and are garbage collected from the Database by CollectExpired().
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Collection that indexes everything with an expiry time, so we don't have to scan the whole database.
+const expiriesCollection = "expiries"
+
+// Entry in the expiries collection. Qname is empty for resolvers.
+type expiryIndexEntry struct {
+	ExpiresAt  time.Time `json:"expires_at"`
+	ResolverId string    `json:"resolver_id"`
+	Qtype      uint16    `json:"qtype,omitempty"`
+	Qname      string    `json:"qname,omitempty"`
+}
+
+func (e expiryIndexEntry) resource() string {
+	if e.Qname == "" {
+		return "resolver-" + e.ResolverId
+	}
+	return "message-" + e.ResolverId + "-" + strconv.Itoa(int(e.Qtype)) + "-" + e.Qname
+}
+
+// Turns a relative lifetime into an absolute one. Leaves an existing absolute lifetime alone.
+func expiresAt(expiresAt *time.Time, ttlSeconds int) *time.Time {
+	if expiresAt == nil && ttlSeconds > 0 {
+		t := time.Now().UTC().Add(time.Duration(ttlSeconds) * time.Second)
+		return &t
+	}
+	return expiresAt
+}
+
+func isExpired(expiresAt *time.Time) bool {
+	return expiresAt != nil && !time.Now().Before(*expiresAt)
+}
+
+func (m DnsMessage) Expired() bool {
+	return isExpired(m.ExpiresAt)
+}
+
+func (r Resolver) Expired() bool {
+	return isExpired(r.ExpiresAt)
+}
+
+// Adds entry to the expiry index if expiresAt is set, otherwise makes sure it is not in the index.
+func (d Database) indexExpiry(entry expiryIndexEntry, expiresAt *time.Time) error {
+	if expiresAt == nil {
+		// Not finding an entry to delete is not an error
+		d.db.Delete(expiriesCollection, entry.resource())
+		return nil
+	}
+	entry.ExpiresAt = *expiresAt
+	return d.db.Write(expiriesCollection, entry.resource(), entry)
+}
+
+func (d Database) readExpiryIndex() (error, []expiryIndexEntry) {
+	jsonStrings, err := d.db.ReadAll(expiriesCollection)
+	if err != nil {
+		return err, nil
+	}
+	var entries []expiryIndexEntry
+	for _, jsonString := range jsonStrings {
+		var entry expiryIndexEntry
+		if err := json.NewDecoder(bytes.NewBufferString(jsonString)).Decode(&entry); err != nil {
+			logger.Warn("Could not decode expiry index entry", "error", err)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	return nil, entries
+}
+
+// Deletes expired DnsMessages and Resolvers from the database every interval, forever.
+// Sends to reloadChannel if any resolvers were deleted. An interval of 0 disables garbage collection.
+func CollectExpired(db *Database, reloadChannel chan<- bool, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		if db.collectExpired() {
+			reloadChannel <- true
+		}
+	}
+}
+
+// Returns true if any resolver was deleted.
+func (d Database) collectExpired() bool {
+	// We get err if the index doesn't exist yet, which is not an error
+	_, entries := d.readExpiryIndex()
+	resolversDeleted := false
+	now := time.Now()
+	var expiredMessages []expiryIndexEntry
+	for _, entry := range entries {
+		if now.Before(entry.ExpiresAt) {
+			continue
+		}
+		if entry.Qname == "" {
+			logger.Info("Deleting expired resolver", "resolver", entry.ResolverId, "expires_at", entry.ExpiresAt)
+			if err := d.DeleteResolver(Resolver{Id: entry.ResolverId}); err != nil {
+				logger.Warn("Could not delete expired resolver", "resolver", entry.ResolverId, "error", err)
+				continue
+			}
+			d.deleteResolverData(entry.ResolverId)
+			resolversDeleted = true
+		} else {
+			expiredMessages = append(expiredMessages, entry)
+		}
+	}
+	if len(expiredMessages) > 0 {
+		d.collectExpiredMessages(expiredMessages)
+	}
+	return resolversDeleted
+}
+
+// Deletes expired DnsMessages, and journals their deletion from zones
+func (d Database) collectExpiredMessages(entries []expiryIndexEntry) {
+	var resolverIds, qnames []string
+	for _, entry := range entries {
+		resolverIds = append(resolverIds, entry.ResolverId)
+		qnames = append(qnames, entry.Qname)
+	}
+	d.journaledExpiry(resolverIds, qnames, func() error {
+		for _, entry := range entries {
+			logger.Info("Deleting expired DNS message", "resolver", entry.ResolverId, "qtype", entry.Qtype,
+				"qname", entry.Qname, "expires_at", entry.ExpiresAt)
+			d.deleteResolverDnsMessage(entry.ResolverId, entry.Qtype, entry.Qname)
+		}
+		return nil
+	})
+}
+
+// Deletes everything that belongs to resolverId, except the resolver itself: its DnsMessages, including those of its
+// views and secondary zones, their expiry index entries, and its zone journals, secondary zone states and DNSSEC keys.
+func (d Database) deleteResolverData(resolverId string) {
+	for _, storageId := range d.storageIds(resolverId) {
+		for _, qtype := range d.storedQtypes(storageId) {
+			for _, qname := range d.storedQnames(storageId, qtype) {
+				d.deleteResolverDnsMessage(storageId, qtype, qname)
+			}
+		}
+		if err := d.db.Delete(storageId, ""); err != nil {
+			logger.Warn("Could not delete DNS messages", "resolver", resolverId, "storage_id", storageId, "error", err)
+		}
+	}
+	// We get err if a collection doesn't exist yet, which is not an error
+	_, journals := d.readAllZoneJournals()
+	for _, journal := range journals {
+		if journal.Resolver == resolverId {
+			d.deleteZoneJournal(journal.Resolver, journal.Zone)
+		}
+	}
+	_, secondaryZones := d.readAllSecondaryZones()
+	for _, secondaryZone := range secondaryZones {
+		if secondaryZone.Resolver == resolverId {
+			d.deleteSecondaryZone(secondaryZone.Resolver, secondaryZone.Zone)
+		}
+	}
+	_, keys := d.ReadAllDnssecKeys()
+	for _, key := range keys {
+		if key.Resolver == resolverId {
+			d.DeleteDnssecKey(key)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package yesdns
+
+// Fault injection for testing how clients cope with misbehaving DNS servers.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Artificial latency added before a response is written.
+// A fixed delay, a random delay between min and max, or both.
+type Delay struct {
+	FixedMs int `json:"fixed_ms"`
+	MinMs   int `json:"min_ms"`
+	MaxMs   int `json:"max_ms"`
+}
+
+func (d Delay) Duration() time.Duration {
+	ms := d.FixedMs + d.MinMs
+	if d.MaxMs > d.MinMs {
+		ms += rand.Intn(d.MaxMs - d.MinMs + 1)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Returns an error if delay has a negative number of milliseconds. delay may be nil.
+func validateDelay(delay *Delay) error {
+	if delay != nil && (delay.FixedMs < 0 || delay.MinMs < 0 || delay.MaxMs < 0) {
+		return errors.New(fmt.Sprintf("Delay of %d, %d or %d ms is negative", delay.FixedMs, delay.MinMs,
+			delay.MaxMs))
+	}
+	return nil
+}
+
+// A delay on the DnsMessage takes precedence over a delay on the Resolver.
+// resolvedDnsMessage is nil if the query was not answered from the database.
+func responseDelay(resolver *Resolver, resolvedDnsMessage *DnsMessage) time.Duration {
+	if resolvedDnsMessage != nil && resolvedDnsMessage.Delay != nil {
+		return resolvedDnsMessage.Delay.Duration()
+	}
+	if resolver.Delay != nil {
+		return resolver.Delay.Duration()
+	}
+	return 0
+}
+
+// Kinds of fault
+const (
+	FaultDrop      = "drop"
+	FaultTruncate  = "truncate"
+	FaultServFail  = "servfail"
+	FaultRefused   = "refused"
+	FaultWrongId   = "wrong_id"
+	FaultMalformed = "malformed"
+)
+
+// Probabilities (0.0 - 1.0) of misbehaving in a given way when responding to a query.
+// Probabilities are cumulative, so they should add up to at most 1.0.
+// If Seed is not 0, the sequence of injected faults is the same every time the policy is (re)configured, i.e. every
+// time the DnsMessage or Resolver it belongs to is saved.
+type Fault struct {
+	Drop      float64 `json:"drop"`
+	Truncate  float64 `json:"truncate"`
+	ServFail  float64 `json:"servfail"`
+	Refused   float64 `json:"refused"`
+	WrongId   float64 `json:"wrong_id"`
+	Malformed float64 `json:"malformed"`
+	Seed      int64   `json:"seed"`
+}
+
+// Returns an error if a probability of fault is not between 0.0 and 1.0, or if they add up to more than 1.0.
+// fault may be nil.
+func validateFaults(fault *Fault) error {
+	if fault == nil {
+		return nil
+	}
+	var sum float64
+	for _, probability := range []float64{fault.Drop, fault.Truncate, fault.ServFail, fault.Refused, fault.WrongId,
+		fault.Malformed} {
+		if probability < 0 || probability > 1 {
+			return errors.New(fmt.Sprintf("Fault probability %v is not between 0.0 and 1.0", probability))
+		}
+		sum += probability
+	}
+	// Allow for rounding, e.g. of 0.1 + 0.2 + 0.7
+	if sum > 1+1e-9 {
+		return errors.New(fmt.Sprintf("Fault probabilities add up to %v, more than 1.0", sum))
+	}
+	return nil
+}
+
+// Random number generators of seeded Fault policies, indexed by the key of the thing the policy is attached to.
+var faultRands = struct {
+	sync.Mutex
+	byKey map[string]*faultRand
+}{byKey: make(map[string]*faultRand)}
+
+type faultRand struct {
+	fault Fault
+	rand  *rand.Rand
+}
+
+// Starts the sequence of a seeded policy over, e.g. because the DnsMessage was replaced.
+func resetFaultSequence(key string) {
+	faultRands.Lock()
+	delete(faultRands.byKey, key)
+	faultRands.Unlock()
+}
+
+// Returns a number in [0.0,1.0). Draws from a generator that is private to key if the policy is seeded.
+func (f Fault) draw(key string) float64 {
+	if f.Seed == 0 {
+		return rand.Float64()
+	}
+	faultRands.Lock()
+	defer faultRands.Unlock()
+	r, ok := faultRands.byKey[key]
+	if !ok || r.fault != f {
+		// Policy is new or has changed, so restart the sequence
+		r = &faultRand{fault: f, rand: rand.New(rand.NewSource(f.Seed))}
+		faultRands.byKey[key] = r
+	}
+	return r.rand.Float64()
+}
+
+// Returns one of the Fault* constants, or "" for no fault.
+func (f Fault) Pick(key string) string {
+	draw := f.draw(key)
+	var cumulative float64
+	for _, choice := range []struct {
+		probability float64
+		fault       string
+	}{
+		{f.Drop, FaultDrop},
+		{f.Truncate, FaultTruncate},
+		{f.ServFail, FaultServFail},
+		{f.Refused, FaultRefused},
+		{f.WrongId, FaultWrongId},
+		{f.Malformed, FaultMalformed},
+	} {
+		cumulative += choice.probability
+		if draw < cumulative {
+			return choice.fault
+		}
+	}
+	return ""
+}
+
+// A fault policy on the DnsMessage takes precedence over a policy on the Resolver.
+// resolvedDnsMessage is nil if the query was not answered from the database.
+func responseFault(resolver *Resolver, resolvedDnsMessage *DnsMessage) string {
+	if resolvedDnsMessage != nil && resolvedDnsMessage.Fault != nil {
+		return resolvedDnsMessage.Fault.Pick(resolvedDnsMessage.counterKey)
+	}
+	if resolver.Fault != nil {
+		return resolver.Fault.Pick(resolverFaultKey(resolver.Id))
+	}
+	return ""
+}
+
+// Key of the fault sequence of a Resolver. Keys of DnsMessages are responseCounterKey()s.
+func resolverFaultKey(resolverId string) string {
+	return "resolver/" + resolverId
+}
+
+// Changes responseDnsMsg according to fault. Faults that are not about message content (drop, malformed)
+// are handled when writing the response.
+func applyFault(fault string, requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg) *dns.Msg {
+	switch fault {
+	case FaultTruncate:
+		responseDnsMsg.Truncated = true
+		responseDnsMsg.Answer, responseDnsMsg.Ns, responseDnsMsg.Extra = nil, nil, nil
+	case FaultServFail, FaultRefused:
+		responseDnsMsg = new(dns.Msg)
+		if fault == FaultServFail {
+			responseDnsMsg.SetRcode(requestDnsMsg, dns.RcodeServerFailure)
+		} else {
+			responseDnsMsg.SetRcode(requestDnsMsg, dns.RcodeRefused)
+		}
+	case FaultWrongId:
+		responseDnsMsg.Id = requestDnsMsg.Id + 1
+	}
+	return responseDnsMsg
+}
+
+// Returns responseDnsMsg in wire format with a header that promises far more questions than there are,
+// so that clients fail to parse it.
+func malformedResponse(responseDnsMsg *dns.Msg) []byte {
+	packed, err := responseDnsMsg.Pack()
+	if err != nil || len(packed) < 12 {
+		packed = make([]byte, 12)
+	}
+	// QDCOUNT
+	packed[4], packed[5] = 0xff, 0xff
+	return packed
+}
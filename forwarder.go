@@ -2,6 +2,7 @@ package yesdns
 
 import (
 	"github.com/miekg/dns"
+	"time"
 )
 
 type Forwarder struct {
@@ -12,7 +13,10 @@ type Forwarder struct {
 // Returns nil dns.Msg on hard error
 func (forwarder Forwarder) Forward(dnsMsg *dns.Msg) (error, *dns.Msg) {
 	dnsClient := dns.Client{}
-	responsDnsMsg, _, err := dnsClient.Exchange(dnsMsg, forwarder.Address)
+	queryTime := time.Now()
+	responsDnsMsg, rtt, err := dnsClient.Exchange(dnsMsg, forwarder.Address)
+	observeForwarder(forwarder, rtt, err)
+	dnstapForwarder(forwarder, queryTime, dnsMsg, responsDnsMsg)
 	if err != nil {
 		// Hard error, so return it
 		return err, nil
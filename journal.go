@@ -0,0 +1,278 @@
+package yesdns
+
+// Change journals of zones, for incremental zone transfers (IXFR, RFC 1995) and NOTIFY (RFC 1996).
+// When /v1/question changes the records of a zone, the change is journaled under a new SOA serial, and the zone's
+// secondaries are notified.
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const zoneJournalsCollection = "zone-journals"
+
+// Number of changes kept per zone. Secondaries that are further behind get a full transfer.
+const maxJournalChanges = 100
+
+// NOTIFY is retried until the secondary answers, at most notifyAttempts times
+const (
+	notifyAttempts      = 5
+	notifyTimeout       = 2 * time.Second
+	notifyRetryInterval = 5 * time.Second
+)
+
+// What changed between two serials of a zone. RRs are in presentation format.
+type ZoneChange struct {
+	FromSerial uint32   `json:"from_serial"`
+	ToSerial   uint32   `json:"to_serial"`
+	Deleted    []string `json:"deleted,omitempty"`
+	Added      []string `json:"added,omitempty"`
+}
+
+type ZoneJournal struct {
+	Resolver string `json:"resolver"`
+	Zone     string `json:"zone"`
+	// Serial of the latest change
+	Serial  uint32       `json:"serial"`
+	Changes []ZoneChange `json:"changes"`
+}
+
+// Serializes journaled writes, so that changes don't get mixed up
+var zoneJournalLock sync.Mutex
+
+// Records of a zone before a write
+type zoneSnapshot struct {
+	resolver *Resolver
+	zone     Zone
+	rrs      []dns.RR
+	// Expired DnsMessages that have not been deleted yet are part of the zone, see Database.journaledExpiry
+	withExpired bool
+}
+
+func (d Database) readZoneJournal(resolverId string, zone string) (error, *ZoneJournal) {
+	journal := ZoneJournal{}
+	err := d.db.Read(zoneJournalsCollection, zoneResource(resolverId, zone), &journal)
+	return err, &journal
+}
+
+func (d Database) writeZoneJournal(journal ZoneJournal) error {
+	return d.db.Write(zoneJournalsCollection, zoneResource(journal.Resolver, journal.Zone), journal)
+}
+
+func (d Database) deleteZoneJournal(resolverId string, zone string) error {
+	return d.db.Delete(zoneJournalsCollection, zoneResource(resolverId, zone))
+}
+
+func (d Database) readAllZoneJournals() (error, []ZoneJournal) {
+	jsonStrings, err := d.db.ReadAll(zoneJournalsCollection)
+	if err != nil {
+		return err, nil
+	}
+	var journals []ZoneJournal
+	for _, jsonString := range jsonStrings {
+		var journal ZoneJournal
+		if err := json.NewDecoder(bytes.NewBufferString(jsonString)).Decode(&journal); err != nil {
+			logger.Warn("Could not decode zone journal", "error", err)
+		} else {
+			journals = append(journals, journal)
+		}
+	}
+	return nil, journals
+}
+
+// True if serial a is newer than b in serial number arithmetic (RFC 1982)
+func serialNewer(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// Runs write, which changes the DnsMessages for qnames in resolverIds, and journals the changes it makes to zones.
+func (d *Database) journaled(resolverIds []string, qnames []string, write func() error) error {
+	return d.journaledWrite(resolverIds, qnames, false, write)
+}
+
+// Like journaled, for write deleting expired DnsMessages. They stopped being served when they expired, but are only
+// journaled as deleted now, so the zone's serial changes and secondaries are notified within one garbage collection
+// interval.
+func (d *Database) journaledExpiry(resolverIds []string, qnames []string, write func() error) error {
+	return d.journaledWrite(resolverIds, qnames, true, write)
+}
+
+func (d *Database) journaledWrite(resolverIds []string, qnames []string, withExpired bool, write func() error) error {
+	zoneJournalLock.Lock()
+	defer zoneJournalLock.Unlock()
+	snapshots := d.snapshotZones(resolverIds, qnames, withExpired)
+	if err := write(); err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		snapshot.journal()
+	}
+	return nil
+}
+
+// Takes snapshots of the zones of resolverIds that contain one of qnames
+func (d *Database) snapshotZones(resolverIds []string, qnames []string, withExpired bool) []zoneSnapshot {
+	var snapshots []zoneSnapshot
+	seen := make(map[string]bool)
+	for _, resolverId := range resolverIds {
+		if seen[resolverId] {
+			continue
+		}
+		seen[resolverId] = true
+		err, resolver := d.ReadResolver(resolverId)
+		if err != nil || resolver == nil {
+			continue
+		}
+		for _, zone := range resolver.Zones {
+			for _, qname := range qnames {
+				if zone.Contains(qname) {
+					snapshots = append(snapshots, zoneSnapshot{resolver: resolver, zone: zone,
+						rrs: resolver.storedZoneRecords(zone, withExpired), withExpired: withExpired})
+					break
+				}
+			}
+		}
+	}
+	return snapshots
+}
+
+// Journals the difference between the snapshot and the current records of the zone under a new serial, and
+// notifies the zone's secondaries.
+func (s zoneSnapshot) journal() {
+	r := s.resolver
+	before := make(map[string]bool)
+	for _, rr := range s.rrs {
+		before[rr.String()] = true
+	}
+	change := ZoneChange{}
+	after := make(map[string]bool)
+	for _, rr := range r.storedZoneRecords(s.zone, s.withExpired) {
+		after[rr.String()] = true
+		if !before[rr.String()] {
+			change.Added = append(change.Added, rr.String())
+		}
+	}
+	for _, rr := range s.rrs {
+		if !after[rr.String()] {
+			change.Deleted = append(change.Deleted, rr.String())
+		}
+	}
+	if len(change.Added) == 0 && len(change.Deleted) == 0 {
+		return
+	}
+
+	soa := r.zoneSoa(s.zone)
+	change.FromSerial = soa.Serial
+	change.ToSerial = soa.Serial + 1
+	_, journal := r.Database.readZoneJournal(r.Id, s.zone.Apex)
+	journal.Resolver = r.Id
+	journal.Zone = s.zone.canonicalApex()
+	journal.Serial = change.ToSerial
+	journal.Changes = append(journal.Changes, change)
+	if len(journal.Changes) > maxJournalChanges {
+		journal.Changes = journal.Changes[len(journal.Changes)-maxJournalChanges:]
+	}
+	if err := r.Database.writeZoneJournal(*journal); err != nil {
+		logger.Error("Could not write zone journal", "resolver", r.Id, "zone", s.zone.Apex, "error", err)
+		return
+	}
+	logger.Info("Zone changed", "resolver", r.Id, "zone", s.zone.Apex, "serial", change.ToSerial,
+		"added", len(change.Added), "deleted", len(change.Deleted))
+	soa.Serial = change.ToSerial
+	r.notifySecondaries(s.zone, soa)
+}
+
+// Returns the RRs of an incremental transfer from clientSerial to the serial of soa, or nil if the journal doesn't
+// go back that far.
+func (r Resolver) incrementalTransfer(zone Zone, soa *dns.SOA, clientSerial uint32) []dns.RR {
+	if !serialNewer(soa.Serial, clientSerial) {
+		// Client is up to date
+		return []dns.RR{soa}
+	}
+	err, journal := r.Database.readZoneJournal(r.Id, zone.Apex)
+	if err != nil {
+		return nil
+	}
+	start := -1
+	for i, change := range journal.Changes {
+		if change.FromSerial == clientSerial {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	rrs := []dns.RR{soa}
+	serial := clientSerial
+	for _, change := range journal.Changes[start:] {
+		if change.FromSerial != serial {
+			return nil
+		}
+		rrs = append(rrs, soaWithSerial(soa, change.FromSerial))
+		for _, deleted := range change.Deleted {
+			if rr, err := dns.NewRR(deleted); err == nil && rr != nil {
+				rrs = append(rrs, rr)
+			}
+		}
+		rrs = append(rrs, soaWithSerial(soa, change.ToSerial))
+		for _, added := range change.Added {
+			if rr, err := dns.NewRR(added); err == nil && rr != nil {
+				rrs = append(rrs, rr)
+			}
+		}
+		serial = change.ToSerial
+	}
+	if serial != soa.Serial {
+		// The SOA was replaced with a newer serial that is not in the journal
+		return nil
+	}
+	return append(rrs, soa)
+}
+
+func soaWithSerial(soa *dns.SOA, serial uint32) *dns.SOA {
+	copied := dns.Copy(soa).(*dns.SOA)
+	copied.Serial = serial
+	return copied
+}
+
+// Sends NOTIFY for zone to all its secondaries, in the background
+func (r Resolver) notifySecondaries(zone Zone, soa *dns.SOA) {
+	for _, address := range zone.Notify {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		go sendNotify(r.Id, address, soa)
+	}
+}
+
+func sendNotify(resolverId string, address string, soa *dns.SOA) {
+	notifyDnsMsg := new(dns.Msg)
+	notifyDnsMsg.SetNotify(soa.Hdr.Name)
+	notifyDnsMsg.Answer = []dns.RR{soa}
+	client := dns.Client{Timeout: notifyTimeout}
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		responseDnsMsg, _, err := client.Exchange(notifyDnsMsg, address)
+		if err == nil && responseDnsMsg.Rcode == dns.RcodeSuccess {
+			logger.Debug("Secondary acknowledged NOTIFY", "resolver", resolverId, "zone", soa.Hdr.Name,
+				"secondary", address, "serial", soa.Serial)
+			return
+		}
+		if err == nil {
+			logger.Warn("Secondary rejected NOTIFY", "resolver", resolverId, "zone", soa.Hdr.Name,
+				"secondary", address, "rcode", dns.RcodeToString[responseDnsMsg.Rcode])
+			return
+		}
+		logger.Debug("NOTIFY failed", "resolver", resolverId, "zone", soa.Hdr.Name, "secondary", address,
+			"attempt", attempt, "error", err)
+		if attempt < notifyAttempts {
+			time.Sleep(notifyRetryInterval)
+		}
+	}
+	logger.Warn("Secondary did not acknowledge NOTIFY", "resolver", resolverId, "zone", soa.Hdr.Name,
+		"secondary", address, "serial", soa.Serial)
+}
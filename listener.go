@@ -3,6 +3,12 @@ package yesdns
 type ResolverListener struct {
 	Net 			string	`json:"net"`
 	Address			string	`json:"address"`
+	// Limits who may query this listener. Checked before Resolver.Acl.
+	Acl				*Acl	`json:"acl,omitempty"`
+	// TSIG keys accepted on this listener, in addition to Resolver.TsigKeys
+	TsigKeys		[]TsigKey	`json:"tsig_keys,omitempty"`
+	// Refuse queries that are not signed
+	RequireTsig		bool	`json:"require_tsig,omitempty"`
 }
 
 func (rl ResolverListener) Key() string {
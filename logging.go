@@ -0,0 +1,85 @@
+package yesdns
+
+// Leveled, structured (JSON) logging.
+// The level can be changed at runtime via SetLogLevel() or the /v1/log-level endpoint.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var logLevel = new(slog.LevelVar)
+
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// Returns the logger used by YesDNS
+func Logger() *slog.Logger {
+	return logger
+}
+
+// Sets the minimum level that will be logged. One of debug, info, warn or error.
+func SetLogLevel(level string) error {
+	var newLevel slog.Level
+	if err := newLevel.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return fmt.Errorf("unknown log level '%s'", level)
+	}
+	logLevel.Set(newLevel)
+	return nil
+}
+
+// Returns the current log level in lower case
+func LogLevel() string {
+	return strings.ToLower(logLevel.Level().String())
+}
+
+// Defers formatting of a value (e.g. a *dns.Msg) until a log record is actually written.
+// This keeps DEBUG logging of messages free when DEBUG is disabled.
+type stringerLogValue struct {
+	value fmt.Stringer
+}
+
+func (v stringerLogValue) LogValue() slog.Value {
+	return slog.StringValue(v.value.String())
+}
+
+func stringerAttr(key string, value fmt.Stringer) slog.Attr {
+	return slog.Any(key, stringerLogValue{value: value})
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// Handler for the /v1/log-level endpoint
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(logLevelBody{Level: LogLevel()})
+	} else if r.Method == http.MethodPut {
+		// The log level is shared by all resolvers
+		if !unrestrictedRequest(r) {
+			http.Error(w, "Not allowed to change the log level of all resolvers\n", http.StatusForbidden)
+			return
+		}
+		if r.Body == nil {
+			http.Error(w, "Empty body not allowed", http.StatusBadRequest)
+			return
+		}
+		var body logLevelBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := SetLogLevel(body.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info("Log level changed", "level", LogLevel())
+	} else {
+		http.Error(w, fmt.Sprintf("Method %s not allowed for /v1/log-level\n", r.Method), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,253 @@
+package yesdns
+
+// Prometheus metrics for the /metrics endpoint.
+// Metrics are rendered by hand in the Prometheus text exposition format so that we
+// do not have to pull in the full client library.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets, in seconds
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// A counter or gauge with labels
+type metricVec struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(kind string, name string, help string, labels ...string) *metricVec {
+	return &metricVec{kind: kind, name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (m *metricVec) Add(value float64, labelValues ...string) {
+	m.mu.Lock()
+	m.values[labelKey(labelValues)] += value
+	m.mu.Unlock()
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	m.values[labelKey(labelValues)] = value
+	m.mu.Unlock()
+}
+
+// Replaces all values at once. Keys are built from label values with labelKey().
+func (m *metricVec) Replace(values map[string]float64) {
+	m.mu.Lock()
+	m.values = values
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %v\n", m.name, formatLabels(m.labels, splitLabelKey(key), "", ""), m.values[key])
+	}
+}
+
+// A histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		labelValues := splitLabelKey(key)
+		for i, upperBound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", fmt.Sprint(upperBound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, formatLabels(h.labels, labelValues, "", ""), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, labelValues, "", ""), series.count)
+	}
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func splitLabelKey(key string) []string {
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Renders {name="value",...}. extraName/extraValue is used for the histogram 'le' label.
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		if i < len(values) {
+			pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//
+// YesDNS metrics
+//
+
+var (
+	metricQueries = newMetricVec("counter", "yesdns_queries_total",
+		"DNS queries answered, by resolver, listener, query type and response code.",
+		"resolver", "listener", "qtype", "rcode")
+	metricLookups = newMetricVec("counter", "yesdns_internal_lookups_total",
+		"Internal database lookups, by resolver, match type (exact or wildcard) and result (hit or miss).",
+		"resolver", "match", "result")
+	metricForwarderDuration = newHistogramVec("yesdns_forwarder_duration_seconds",
+		"Round trip time of successful queries to forwarders.",
+		latencyBuckets, "net", "forwarder")
+	metricForwarderErrors = newMetricVec("counter", "yesdns_forwarder_errors_total",
+		"Queries to forwarders that failed with a hard error.",
+		"net", "forwarder")
+	metricFaults = newMetricVec("counter", "yesdns_faults_injected_total",
+		"Responses that were dropped, truncated, failed or corrupted on purpose, by resolver and fault.",
+		"resolver", "fault")
+	metricAclDenials = newMetricVec("counter", "yesdns_acl_denied_total",
+		"Queries refused or dropped by an ACL, by resolver, listener and action.",
+		"resolver", "listener", "action")
+	metricRateLimited = newMetricVec("counter", "yesdns_rate_limited_total",
+		"Responses dropped or slipped by response rate limiting, by resolver and action.",
+		"resolver", "action")
+	metricDnssecValidations = newMetricVec("counter", "yesdns_dnssec_validations_total",
+		"Forwarded responses validated with DNSSEC, by resolver and result (secure, insecure or bogus).",
+		"resolver", "result")
+	metricRestRequests = newMetricVec("counter", "yesdns_rest_requests_total",
+		"REST API requests, by path, method and HTTP status code.",
+		"path", "method", "code")
+	metricRunningListeners = newMetricVec("gauge", "yesdns_running_listeners",
+		"DNS listeners currently running, by network.",
+		"net")
+)
+
+func writeMetrics(w io.Writer) {
+	metricQueries.write(w)
+	metricLookups.write(w)
+	metricForwarderDuration.write(w)
+	metricForwarderErrors.write(w)
+	metricFaults.write(w)
+	metricAclDenials.write(w)
+	metricRateLimited.write(w)
+	metricDnssecValidations.write(w)
+	metricRestRequests.write(w)
+	metricRunningListeners.write(w)
+}
+
+// Handler for the /metrics endpoint
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// Records the status code written by an http.Handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Wraps a REST API handler so that requests to it are counted.
+func instrumentRest(path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		metricRestRequests.Inc(path, r.Method, fmt.Sprint(recorder.status))
+	}
+}
+
+// Counts running listeners by network
+func updateRunningListenersMetric(runningServers map[string]*ServerState) {
+	values := make(map[string]float64)
+	for _, runningServer := range runningServers {
+		values[labelKey([]string{runningServer.Listener.Net})]++
+	}
+	metricRunningListeners.Replace(values)
+}
+
+func observeForwarder(forwarder Forwarder, rtt time.Duration, err error) {
+	if err != nil {
+		metricForwarderErrors.Inc(forwarder.Net, forwarder.Address)
+	} else {
+		metricForwarderDuration.Observe(rtt.Seconds(), forwarder.Net, forwarder.Address)
+	}
+}
@@ -3,6 +3,7 @@ package yesdns
 import (
     "github.com/miekg/dns"
     "fmt"
+    "time"
 )
 
 func dnsMsgToString(msg *dns.Msg) string {
@@ -42,9 +43,34 @@ type DnsQuestion struct {
 
 type DnsMessage struct {
     Resolvers  []string		`json:"resolvers"`
+    // Name of a ResolverView. Only served to clients in that view.
+    View       string		`json:"view,omitempty"`
     MsgHdr     DnsHeader	`json:"header"`
     Question   []DnsQuestion	`json:"question"`
     Answer     []DnsRR		`json:"answer"`
     Ns         []DnsRR		`json:"ns"`
     Extra      []DnsRR		`json:"extra"`
+    // Alternative responses. If given, they replace header, answer, ns and extra above.
+    Responses  []DnsResponse	`json:"responses,omitempty"`
+    Selection  string		`json:"selection,omitempty"`
+    Loop       bool		`json:"loop,omitempty"`
+    // One of fixed (default), random or cyclic
+    RrsetOrder string		`json:"rrset_order,omitempty"`
+    // Fault injection
+    Delay      *Delay		`json:"delay,omitempty"`
+    Fault      *Fault		`json:"fault,omitempty"`
+    // Lifetime. ttl_seconds is turned into expires_at when the message is saved.
+    ExpiresAt  *time.Time	`json:"expires_at,omitempty"`
+    TtlSeconds int		`json:"ttl_seconds,omitempty"`
+    // responseCounterKey() of the stored message this was read from. Set by Resolver.lookup().
+    counterKey string
+}
+
+// Qnames of all questions in m
+func (m DnsMessage) qnames() []string {
+	var qnames []string
+	for _, question := range m.Question {
+		qnames = append(qnames, question.Qname)
+	}
+	return qnames
 }
@@ -0,0 +1,93 @@
+package yesdns
+
+// Mutual TLS for the REST API. Clients must present a certificate signed by the CA in -tls-client-ca-file.
+// Certificate subjects can optionally be mapped to scopes and resolvers, see ClientSubject.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Permissions of the clients whose certificate has Subject, either the full distinguished name
+// (e.g. CN=ci,O=Team A) or just the common name.
+type ClientSubject struct {
+	Subject string `json:"subject"`
+	Scope   string `json:"scope"`
+	// Resolver ids the client may write to. Empty means all.
+	Resolvers []string `json:"resolvers,omitempty"`
+	// Tenant whose resolvers the client may write to. Empty means all tenants.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+var (
+	clientSubjects      []ClientSubject
+	clientSubjectsMutex sync.RWMutex
+)
+
+// Replaces the client certificate subjects that may use the REST API.
+// No subjects means any client with a valid certificate may do anything.
+func SetClientSubjects(subjects []ClientSubject) {
+	clientSubjectsMutex.Lock()
+	defer clientSubjectsMutex.Unlock()
+	clientSubjects = subjects
+}
+
+// Reads a JSON array of ClientSubject
+func ReadClientSubjectsFile(path string) (error, []ClientSubject) {
+	file, err := os.Open(path)
+	if err != nil {
+		return err, nil
+	}
+	defer file.Close()
+	var subjects []ClientSubject
+	if err := json.NewDecoder(file).Decode(&subjects); err != nil {
+		return err, nil
+	}
+	for _, subject := range subjects {
+		if subject.Scope != ScopeRead && subject.Scope != ScopeWrite {
+			return errors.New(fmt.Sprintf("Invalid scope %s for subject %s. Expected %s or %s", subject.Scope,
+				subject.Subject, ScopeRead, ScopeWrite)), nil
+		}
+	}
+	return nil, subjects
+}
+
+// Returns the ClientSubject matching the verified client certificate of r, or nil if there is none.
+// Returns ok false if subject mapping is disabled.
+func requestClientSubject(r *http.Request) (*ClientSubject, bool) {
+	clientSubjectsMutex.RLock()
+	defer clientSubjectsMutex.RUnlock()
+	if len(clientSubjects) == 0 {
+		return nil, false
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, true
+	}
+	certificate := r.TLS.VerifiedChains[0][0]
+	for i, subject := range clientSubjects {
+		if subject.Subject == certificate.Subject.String() || subject.Subject == certificate.Subject.CommonName {
+			return &clientSubjects[i], true
+		}
+	}
+	logger.Info("Unknown client certificate subject", "subject", certificate.Subject.String())
+	return nil, true
+}
+
+// TLS configuration that requires clients to present a certificate signed by a CA in caFile
+func clientCaTlsConfig(caFile string) (error, *tls.Config) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New(fmt.Sprintf("No certificates found in %s", caFile)), nil
+	}
+	return nil, &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+}
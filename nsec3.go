@@ -0,0 +1,145 @@
+package yesdns
+
+// NSEC3 proofs of nonexistence for DNSSEC validation (RFC 5155 section 8), see validate.go.
+
+import (
+	"github.com/miekg/dns"
+)
+
+// NSEC3 records with more iterations make responses insecure, so that they can't make us hash forever
+// (RFC 9276 section 3.2)
+const maxNsec3Iterations = 150
+
+// NSEC3 flag that says unsigned delegations may be skipped (RFC 5155 section 3.1.2.1)
+const nsec3OptOut = 1
+
+// Returns the NSEC3 records that use a hash algorithm we know (RFC 5155 section 8.1). expensive is true if one of them
+// has too many iterations.
+func usableNsec3s(nsec3s []*dns.NSEC3) (usable []*dns.NSEC3, expensive bool) {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash != dns.SHA1 {
+			continue
+		}
+		if nsec3.Iterations > maxNsec3Iterations {
+			return nil, true
+		}
+		usable = append(usable, nsec3)
+	}
+	return usable, false
+}
+
+// Returns the NSEC3 whose owner is the hash of name, or nil if there is none
+func nsec3Matching(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(dns.Fqdn(name)) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// Returns the NSEC3 whose owner and next hashed name are around the hash of name, or nil if there is none
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if !nsec3.Match(dns.Fqdn(name)) && nsec3.Cover(dns.Fqdn(name)) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func nsec3HasType(nsec3 *dns.NSEC3, qtype uint16) bool {
+	for _, t := range nsec3.TypeBitMap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the closest encloser of name, the longest ancestor that exists, and the NSEC3 that covers the next closer name,
+// the ancestor one label longer (RFC 5155 section 8.3). Returns a nil NSEC3 if there is no such proof.
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.CountLabel(name)
+	for count := labels - 1; count >= 0; count-- {
+		candidate := lastLabels(name, count)
+		matching := nsec3Matching(nsec3s, candidate)
+		if matching == nil {
+			continue
+		}
+		// Names below a delegation or DNAME are not in this zone, so the server should have referred us there
+		if nsec3HasType(matching, dns.TypeDNAME) ||
+			nsec3HasType(matching, dns.TypeNS) && !nsec3HasType(matching, dns.TypeSOA) {
+			return "", nil
+		}
+		return candidate, nsec3Covering(nsec3s, lastLabels(name, count+1))
+	}
+	return "", nil
+}
+
+func wildcardAt(name string) string {
+	if dns.CanonicalName(name) == "." {
+		return "*."
+	}
+	return "*." + dns.Fqdn(name)
+}
+
+// Checks the NSEC3 proof that question has no answer, for an NXDOMAIN response (RFC 5155 section 8.4) or a NODATA
+// response (sections 8.5 to 8.7). Compact denial of existence (RFC 9824) answers nonexistent names as NODATA.
+func nsec3Proof(question dns.Question, rcode int, nsec3s []*dns.NSEC3) string {
+	usable, expensive := usableNsec3s(nsec3s)
+	if expensive {
+		return ValidationInsecure
+	}
+	if rcode != dns.RcodeNameError {
+		if matching := nsec3Matching(usable, question.Name); matching != nil {
+			if nsec3HasType(matching, question.Qtype) || nsec3HasType(matching, dns.TypeCNAME) {
+				return ValidationBogus
+			}
+			return ValidationSecure
+		}
+	}
+	closestEncloser, nextCloser := nsec3ClosestEncloser(usable, question.Name)
+	if nextCloser == nil {
+		return ValidationBogus
+	}
+	if rcode == dns.RcodeNameError {
+		// No wildcard could have matched either
+		if nsec3Covering(usable, wildcardAt(closestEncloser)) == nil {
+			return ValidationBogus
+		}
+		return ValidationSecure
+	}
+	// A wildcard matched, but doesn't have the type
+	if wildcard := nsec3Matching(usable, wildcardAt(closestEncloser)); wildcard != nil {
+		if nsec3HasType(wildcard, question.Qtype) || nsec3HasType(wildcard, dns.TypeCNAME) {
+			return ValidationBogus
+		}
+		return ValidationSecure
+	}
+	// No DS because the name is an unsigned delegation skipped by opt-out
+	if question.Qtype == dns.TypeDS && nextCloser.Flags&nsec3OptOut != 0 {
+		return ValidationInsecure
+	}
+	return ValidationBogus
+}
+
+// Checks the NSEC3 proof that zone is an unsigned delegation: zone has NS but no DS, or is skipped by opt-out
+// (RFC 5155 section 8.9)
+func nsec3InsecureDelegation(zone string, nsec3s []*dns.NSEC3) string {
+	usable, expensive := usableNsec3s(nsec3s)
+	if expensive {
+		return ValidationInsecure
+	}
+	if matching := nsec3Matching(usable, zone); matching != nil {
+		if nsec3HasType(matching, dns.TypeNS) && !nsec3HasType(matching, dns.TypeDS) &&
+			!nsec3HasType(matching, dns.TypeSOA) {
+			return ValidationInsecure
+		}
+		return ValidationBogus
+	}
+	if _, nextCloser := nsec3ClosestEncloser(usable, zone); nextCloser != nil && nextCloser.Flags&nsec3OptOut != 0 {
+		return ValidationInsecure
+	}
+	return ValidationBogus
+}
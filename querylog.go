@@ -0,0 +1,236 @@
+package yesdns
+
+// Bounded in-memory log of received queries and the responses we gave.
+// Intended for test assertions via GET /v1/queries.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How a query was answered
+const (
+	AnsweredByInternal  = "internal"
+	AnsweredByWildcard  = "wildcard"
+	AnsweredByForwarder = "forwarder"
+	AnsweredByNone      = "none"
+	// Refused or dropped by an ACL
+	AnsweredByAcl = "acl"
+	// Negative answer or DNSKEY made up for a zone
+	AnsweredByZone = "zone"
+)
+
+const DefaultQueryLogSize = 1000
+
+type QueryLogEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Resolver   string    `json:"resolver"`
+	Listener   string    `json:"listener"`
+	Net        string    `json:"net"`
+	Qname      string    `json:"qname"`
+	Qtype      uint16    `json:"qtype"`
+	Rcode      int       `json:"rcode"`
+	AnsweredBy string    `json:"answered_by"`
+	Fault      string    `json:"fault,omitempty"`
+}
+
+// Ring buffer of QueryLogEntry. Oldest entries are overwritten when full.
+type QueryLog struct {
+	mu      sync.Mutex
+	entries []QueryLogEntry
+	next    int
+	full    bool
+}
+
+func NewQueryLog(size int) *QueryLog {
+	return &QueryLog{entries: make([]QueryLogEntry, size)}
+}
+
+var queryLog = NewQueryLog(DefaultQueryLogSize)
+
+// Replaces the query log with an empty one holding at most size entries. A size of 0 disables the query log.
+func SetQueryLogSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	queryLog = NewQueryLog(size)
+}
+
+func (q *QueryLog) Add(entry QueryLogEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return
+	}
+	q.entries[q.next] = entry
+	q.next = (q.next + 1) % len(q.entries)
+	if q.next == 0 {
+		q.full = true
+	}
+}
+
+// Returns all entries, oldest first, for which filter returns true.
+func (q *QueryLog) Entries(filter func(entry QueryLogEntry) bool) []QueryLogEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ordered []QueryLogEntry
+	if q.full {
+		ordered = append(ordered, q.entries[q.next:]...)
+	}
+	ordered = append(ordered, q.entries[:q.next]...)
+	matches := []QueryLogEntry{}
+	for _, entry := range ordered {
+		if filter(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	return matches
+}
+
+func (q *QueryLog) Reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next = 0
+	q.full = false
+}
+
+func recordQuery(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg,
+	resolver *Resolver, listener ResolverListener, answeredBy string, fault string) {
+	entry := QueryLogEntry{
+		Time:       time.Now().UTC(),
+		Resolver:   resolver.Id,
+		Listener:   listener.Key(),
+		Net:        listener.Net,
+		Rcode:      responseDnsMsg.Rcode,
+		AnsweredBy: answeredBy,
+		Fault:      fault,
+	}
+	if remoteAddr := dnsResponseWriter.RemoteAddr(); remoteAddr != nil {
+		entry.Client = remoteAddr.String()
+	}
+	if len(requestDnsMsg.Question) > 0 {
+		entry.Qname = requestDnsMsg.Question[0].Name
+		entry.Qtype = requestDnsMsg.Question[0].Qtype
+	}
+	queryLog.Add(entry)
+}
+
+// Builds a filter from query string parameters.
+// Supported parameters: qname, qtype, rcode, resolver, listener, net, client, answered_by, fault and since (RFC3339).
+// qtype and rcode may be numeric or mnemonic (e.g. A, NXDOMAIN).
+func queryLogFilter(params map[string][]string) (error, func(entry QueryLogEntry) bool) {
+	get := func(name string) string {
+		if values, ok := params[name]; ok && len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	qname := get("qname")
+	if qname != "" {
+		qname = dns.Fqdn(qname)
+	}
+	qtype := -1
+	if value := get("qtype"); value != "" {
+		if t, ok := dns.StringToType[strings.ToUpper(value)]; ok {
+			qtype = int(t)
+		} else if t, err := strconv.ParseUint(value, 10, 16); err == nil {
+			qtype = int(t)
+		} else {
+			return fmt.Errorf("invalid qtype '%s'", value), nil
+		}
+	}
+	rcode := -1
+	if value := get("rcode"); value != "" {
+		if r, ok := dns.StringToRcode[strings.ToUpper(value)]; ok {
+			rcode = r
+		} else if r, err := strconv.Atoi(value); err == nil {
+			rcode = r
+		} else {
+			return fmt.Errorf("invalid rcode '%s'", value), nil
+		}
+	}
+	var since time.Time
+	if value := get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("invalid since '%s': %s", value, err), nil
+		}
+	}
+	resolver, listener, net, client, answeredBy, fault := get("resolver"), get("listener"), get("net"), get("client"),
+		get("answered_by"), get("fault")
+
+	return nil, func(entry QueryLogEntry) bool {
+		switch {
+		case qname != "" && !strings.EqualFold(qname, entry.Qname):
+			return false
+		case qtype >= 0 && uint16(qtype) != entry.Qtype:
+			return false
+		case rcode >= 0 && rcode != entry.Rcode:
+			return false
+		case !since.IsZero() && entry.Time.Before(since):
+			return false
+		case resolver != "" && resolver != entry.Resolver:
+			return false
+		case listener != "" && listener != entry.Listener:
+			return false
+		case net != "" && net != entry.Net:
+			return false
+		// Client may be given with or without port
+		case client != "" && client != entry.Client && !strings.HasPrefix(entry.Client, client+":") &&
+			!strings.HasPrefix(entry.Client, "["+client+"]:"):
+			return false
+		case answeredBy != "" && answeredBy != entry.AnsweredBy:
+			return false
+		case fault != "" && fault != entry.Fault:
+			return false
+		}
+		return true
+	}
+}
+
+// Handler for the /v1/queries endpoint
+func serveQueryLog(database *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			err, filter := queryLogFilter(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Only show queries to resolvers the client may write to
+			tenantResolvers := make(map[string]bool)
+			if requestTenant(r) != "" {
+				// We get err if there are no resolvers yet, which is not an error
+				_, resolvers := database.ReadStoredResolvers()
+				for _, resolver := range resolvers {
+					tenantResolvers[resolver.Id] = tenantsAllow(r, resolver.Tenant)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(queryLog.Entries(func(entry QueryLogEntry) bool {
+				if requestTenant(r) != "" && !tenantResolvers[entry.Resolver] {
+					return false
+				}
+				return principalsAllowResolver(r, entry.Resolver) && filter(entry)
+			}))
+		} else if r.Method == http.MethodDelete {
+			// The query log is shared by all resolvers
+			if !unrestrictedRequest(r) {
+				http.Error(w, "Not allowed to clear queries of all resolvers\n", http.StatusForbidden)
+				return
+			}
+			queryLog.Reset()
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.Error(w, fmt.Sprintf("Method %s not allowed for /v1/queries\n", r.Method), http.StatusMethodNotAllowed)
+		}
+	}
+}
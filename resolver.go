@@ -7,7 +7,8 @@ package yesdns
 import (
 	"strings"
 	"github.com/miekg/dns"
-	"log"
+	"net"
+	"time"
 )
 
 type ResolverStore struct {
@@ -16,10 +17,36 @@ type ResolverStore struct {
 
 type Resolver struct {
 	Id 				string				`json:"id"`
+	// Owner. API clients scoped to a tenant can only write to resolvers of that tenant.
+	Tenant			string				`json:"tenant,omitempty"`
 	Patterns 		[]string			`json:"patterns"`
 	Store 			ResolverStore		`json:"store"`
 	Listeners 		[]ResolverListener	`json:"listeners"`
 	Forwarders		[]Forwarder			`json:"forwarders"`
+	// Limits who may query this resolver on any of its listeners
+	Acl				*Acl				`json:"acl,omitempty"`
+	// Response rate limiting. Off unless set.
+	RateLimit		*RateLimit			`json:"rate_limit,omitempty"`
+	// TSIG keys accepted on all listeners of this resolver
+	TsigKeys		[]TsigKey			`json:"tsig_keys,omitempty"`
+	// Refuse queries that are not signed
+	RequireTsig		bool				`json:"require_tsig,omitempty"`
+	// EDNS Client Subnet handling when forwarding. One of passthrough (default), strip or add.
+	ForwardEcs		string				`json:"forward_ecs,omitempty"`
+	// UDP payload size advertised in EDNS0 responses. Defaults to DefaultEdnsBufferSize.
+	EdnsBufferSize	uint16				`json:"edns_buffer_size,omitempty"`
+	// Fault injection. Applies to every response unless overridden by the DnsMessage.
+	Delay			*Delay				`json:"delay,omitempty"`
+	Fault			*Fault				`json:"fault,omitempty"`
+	// Lifetime. ttl_seconds is turned into expires_at when the resolver is saved.
+	ExpiresAt		*time.Time			`json:"expires_at,omitempty"`
+	TtlSeconds		int					`json:"ttl_seconds,omitempty"`
+	// Split-horizon. Evaluated in order, first match wins.
+	Views			[]ResolverView		`json:"views,omitempty"`
+	// Zones we are authoritative for. Names in them are never forwarded.
+	Zones			[]Zone				`json:"zones,omitempty"`
+	// Validate forwarded responses with DNSSEC
+	DnssecValidation	*DnssecValidation	`json:"dnssec_validation,omitempty"`
 	// We expect Database connection to match ResolverStore
 	Database		*Database
 }
@@ -35,49 +62,103 @@ func ensureName(rrName string, queryName string) string {
 
 // If an internal error occured (ie ServerFail), error will be set.
 // If name not found (ie NXDomain), DnsMessage will be null.
+// The returned string tells how the answer was found: AnsweredByInternal, AnsweredByWildcard or AnsweredByNone.
+// clientIp and ecsIp (from EDNS Client Subnet) select the view (see ResolverView). Either may be nil.
 //
-// This function is potentially expensive because it can do 2 database lookups and a DNS request in the worst case.
-func (r Resolver) Resolve(qType uint16, qName string) (error, *DnsMessage) {
+// This function is potentially expensive because it can do 6 database lookups in the worst case.
+func (r Resolver) Resolve(qType uint16, qName string, clientIp net.IP, ecsIp net.IP) (error, *DnsMessage, string) {
 	// TODO Type 255 (dns.TypeANY) means any/all records
-	
+
+	// Records in the client's view take precedence over records that are not in any view
+	var storageIds []string
+	if view, _ := r.matchView(clientIp, ecsIp); view != "" {
+		storageIds = append(storageIds, viewStorageId(r.Id, view))
+	}
+	storageIds = append(storageIds, r.Id)
+	// Records transferred from the primary of a secondary zone come last, so the above override them
+	if storageId := r.secondaryStorageIdFor(qName); storageId != "" {
+		storageIds = append(storageIds, storageId)
+	}
+	for _, storageId := range storageIds {
+		if dnsMessage, answeredBy := r.lookup(storageId, qType, qName); dnsMessage != nil {
+			r.countLookup(answeredBy)
+			return nil, dnsMessage, answeredBy
+		}
+	}
+	r.countLookup(AnsweredByNone)
+	return nil, nil, AnsweredByNone
+}
+
+// Counts a lookup in metrics once, no matter how many storage ids it searched.
+func (r Resolver) countLookup(answeredBy string) {
+	switch answeredBy {
+	case AnsweredByInternal:
+		metricLookups.Inc(r.Id, "exact", "hit")
+	case AnsweredByWildcard:
+		metricLookups.Inc(r.Id, "exact", "miss")
+		metricLookups.Inc(r.Id, "wildcard", "hit")
+	default:
+		metricLookups.Inc(r.Id, "exact", "miss")
+		metricLookups.Inc(r.Id, "wildcard", "miss")
+	}
+}
+
+// Looks up qName, then its wildcard, in the records stored under storageId (see viewStorageId).
+func (r Resolver) lookup(storageId string, qType uint16, qName string) (*DnsMessage, string) {
 	// Try normal resolution
-	err, answerDnsMessage := r.Database.ReadResolverDnsMessage(r.Id, qType, qName)
+	err, answerDnsMessage := r.Database.ReadResolverDnsMessage(storageId, qType, qName)
 	if err != nil {
 		// We get err if we couldn't find record, which is not an error
-	} else if answerDnsMessage != nil {
+	} else if answerDnsMessage != nil && !answerDnsMessage.Expired() {
 		// We found an answer, so return it
-		return nil, answerDnsMessage
+		answerDnsMessage.counterKey = responseCounterKey(storageId, qType, qName)
+		// Pick one of the alternative responses, if there are any
+		answerDnsMessage.selectResponse(answerDnsMessage.counterKey)
+		return answerDnsMessage, AnsweredByInternal
 	}
 	
 	// Try wildcard if no result for exact match
 	wildcardQname := qnameToWildcard(qName)
 	// Try lookup again
-	err, wildcardDnsMessage := r.Database.ReadResolverDnsMessage(r.Id, qType, wildcardQname)
+	err, wildcardDnsMessage := r.Database.ReadResolverDnsMessage(storageId, qType, wildcardQname)
 	if err != nil {
 		// We get err if we couldn't find record, which is not an error
-	} else if wildcardDnsMessage != nil {
+	} else if wildcardDnsMessage != nil && !wildcardDnsMessage.Expired() {
 		// We found an answer, so return it
-		// but first, we have to fix the Qname
+		// but first, pick one of the alternative responses, if there are any
+		wildcardDnsMessage.counterKey = responseCounterKey(storageId, qType, wildcardQname)
+		wildcardDnsMessage.selectResponse(wildcardDnsMessage.counterKey)
+		// then, we have to fix the Qname
 		wildcardDnsMessage.Question[0].Qname = qName
 		// And fix RR Names
 		for i := range wildcardDnsMessage.Answer {
 			wildcardDnsMessage.Answer[i].Name = ensureName(wildcardDnsMessage.Answer[i].Name, qName)
 		}
 		// TODO do we need to do the above for Ns and Extra sections too?
-		return nil, wildcardDnsMessage
+		return wildcardDnsMessage, AnsweredByWildcard
 	}
 	
-	return nil, nil
+	return nil, AnsweredByNone
+}
+
+// clientIp is used to add EDNS Client Subnet if configured in ForwardEcs. It may be nil.
+func (r Resolver) Forward(dnsMsg *dns.Msg, clientIp net.IP) (error, *dns.Msg) {
+	if r.DnssecValidation != nil {
+		return r.forwardValidated(dnsMsg, clientIp)
+	}
+	return r.forward(dnsMsg, clientIp)
 }
 
-func (r Resolver) Forward(dnsMsg *dns.Msg) (error, *dns.Msg) {
+func (r Resolver) forward(dnsMsg *dns.Msg, clientIp net.IP) (error, *dns.Msg) {
 	var responsDnsMsg *dns.Msg
 	var exchangeErr error
+	dnsMsg, undoEcs := forwardEcs(r.ForwardEcs, dnsMsg, clientIp)
+	defer func() { undoEcs(responsDnsMsg) }()
 	for _, forwarder := range r.Forwarders {
-		log.Printf("DEBUG Querying forward %s with message \n%s\n", forwarder, dnsMsg)
+		logger.Debug("Querying forwarder", "forwarder", forwarder, stringerAttr("message", dnsMsg))
 		if exchangeErr, responsDnsMsg = forwarder.Forward(dnsMsg); exchangeErr != nil {
 			// Hard error occured. Log a warning and (maybe) try other forwarders.
-			log.Printf("WARN Failed to query forwarder %s. Error was: %s\n", forwarder, exchangeErr)
+			logger.Warn("Failed to query forwarder", "forwarder", forwarder, "error", exchangeErr)
 		} else if responsDnsMsg.Rcode == dns.RcodeSuccess {
 			return nil, responsDnsMsg
 		} else if responsDnsMsg.Rcode == dns.RcodeNameError && responsDnsMsg.RecursionAvailable {
@@ -3,10 +3,10 @@ package yesdns
 // Depends on:
 // resolver.go/SyncResolversWithDatabase
 import (
-	"log"
 	"net/http"
 	"encoding/json"
 	"fmt"
+	"os"
 	//"path/filepath"
 )
 
@@ -14,8 +14,13 @@ import (
 //
 // httpListenAddr: (string) interface and port to listen on
 // database: (*Database) Reference to local database that stores DNS records.
-func ServeRestApi(httpListenAddr string, database *Database, reloadChannel chan <- bool, tlsCertFile string, tlsKeyFile string) {
-	http.HandleFunc("/v1/question", func(w http.ResponseWriter, r *http.Request) {
+// tlsClientCaFile: (string) If set, clients must present a certificate signed by a CA in this file. Requires TLS.
+func ServeRestApi(httpListenAddr string, database *Database, reloadChannel chan <- bool, tlsCertFile string, tlsKeyFile string,
+	tlsClientCaFile string) {
+	// Everything under /v1/ is authenticated, see auth.go
+	api := http.NewServeMux()
+
+	api.HandleFunc("/v1/question", instrumentRest("/v1/question", func(w http.ResponseWriter, r *http.Request) {
 		// Decode json
 		if r.Body == nil {
 			http.Error(w, "Empty body not allowed", http.StatusBadRequest)
@@ -23,25 +28,61 @@ func ServeRestApi(httpListenAddr string, database *Database, reloadChannel chan
 		}
 		var dnsRecord DnsMessage
 		if err := json.NewDecoder(r.Body).Decode(&dnsRecord); err != nil {
-			log.Println(err)
+			logger.Warn("Could not decode DNS message", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if dnsRecord.View != "" {
+			if err := validateViewName(dnsRecord.View); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !authorizedForResolvers(r, dnsRecord.Resolvers...) {
+			http.Error(w, "Not allowed to write to these resolvers\n", http.StatusForbidden)
+			return
+		}
+		if err, status := authorizeDnsMessageWrite(r, database, dnsRecord.Resolvers); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
 		// Handle method
 		if r.Method == http.MethodPut {
 			// TODO validate dnsRecord
-			log.Printf("DEBUG Saving %s\n", dnsRecord)
-			if err := database.WriteDnsMessage(dnsRecord); err != nil {
-				log.Printf("ERROR Error saving %s. Error was: %s\n", dnsRecord, err)
+			for _, resolverId := range dnsRecord.Resolvers {
+				if err := validateResolverId(resolverId); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := dnsRecord.validateSelection(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateDelay(dnsRecord.Delay); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateFaults(dnsRecord.Fault); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Debug("Saving DNS message", "message", dnsRecord)
+			if err := database.journaled(dnsRecord.Resolvers, dnsRecord.qnames(), func() error {
+				return database.WriteDnsMessage(dnsRecord)
+			}); err != nil {
+				logger.Error("Error saving DNS message", "message", dnsRecord, "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			// TODO return 204 No content
 		} else if r.Method == http.MethodDelete {
 			// TODO validate dnsRecord
-			log.Printf("DEBUG Deleting %s\n", dnsRecord)
-			if err := database.DeleteDnsMessage(dnsRecord); err != nil {
-				log.Printf("ERROR Error deleting %s. Error was: %s\n", dnsRecord, err)
+			logger.Debug("Deleting DNS message", "message", dnsRecord)
+			if err := database.journaled(dnsRecord.Resolvers, dnsRecord.qnames(), func() error {
+				return database.DeleteDnsMessage(dnsRecord)
+			}); err != nil {
+				logger.Error("Error deleting DNS message", "message", dnsRecord, "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -50,9 +91,9 @@ func ServeRestApi(httpListenAddr string, database *Database, reloadChannel chan
 			// TODO return json error message
 			http.Error(w, fmt.Sprintf("Method %s not allowed for /v1/question\n", r.Method), http.StatusMethodNotAllowed)
 		}
-	})
+	}))
 
-	http.HandleFunc("/v1/resolver", func(w http.ResponseWriter, r *http.Request) {
+	api.HandleFunc("/v1/resolver", instrumentRest("/v1/resolver", func(w http.ResponseWriter, r *http.Request) {
 		// Decode json
 		if r.Body == nil {
 			http.Error(w, "Empty body not allowed", http.StatusBadRequest)
@@ -60,20 +101,66 @@ func ServeRestApi(httpListenAddr string, database *Database, reloadChannel chan
 		}
 		var resolver Resolver
 		if err := json.NewDecoder(r.Body).Decode(&resolver); err != nil {
-			log.Println(err)
+			logger.Warn("Could not decode resolver", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if !authorizedForResolvers(r, resolver.Id) {
+			http.Error(w, fmt.Sprintf("Not allowed to write to resolver %s\n", resolver.Id), http.StatusForbidden)
+			return
+		}
+		if err, status := authorizeResolverWrite(r, database, &resolver); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
 		if r.Method == http.MethodPut {
+			if err := validateResolverId(resolver.Id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := resolver.validateTsigKeys(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// We get err if there are no resolvers yet, which is not an error
+			_, resolvers := database.ReadAllResolvers()
+			if err := resolver.validateTsigKeyNames(resolvers); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err := resolver.validateDnssecValidation(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := resolver.validateAcls(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := resolver.validateViews(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := resolver.validateZones(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateDelay(resolver.Delay); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateFaults(resolver.Fault); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if err := database.WriteResolver(resolver); err != nil {
-				log.Printf("ERROR Error writing %s. Error was: %s\n", resolver, err)
+				logger.Error("Error writing resolver", "resolver", resolver.Id, "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			reloadChannel <- true
 		} else if r.Method == http.MethodDelete {
 			if err := database.DeleteResolver(resolver); err != nil {
-				log.Printf("ERROR Error deleting %s. Error was: %s\n", resolver, err)
+				logger.Error("Error deleting resolver", "resolver", resolver.Id, "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -82,16 +169,46 @@ func ServeRestApi(httpListenAddr string, database *Database, reloadChannel chan
 			// TODO return json error message
 			http.Error(w, fmt.Sprintf("Method %s not allowed for /v1/resolver\n", r.Method), http.StatusMethodNotAllowed)
 		}
-	})
+	}))
+
+	api.HandleFunc("/v1/tsig-keys", instrumentRest("/v1/tsig-keys", serveTsigKeys(database, reloadChannel)))
+	api.HandleFunc("/v1/dnssec-keys", instrumentRest("/v1/dnssec-keys", serveDnssecKeys(database)))
+
+	api.HandleFunc("/v1/log-level", instrumentRest("/v1/log-level", serveLogLevel))
+
+	api.HandleFunc("/v1/queries", instrumentRest("/v1/queries", serveQueryLog(database)))
+
+	http.Handle("/v1/", authenticate(api))
+
+	// Prometheus metrics. Not authenticated, so scrapers don't need a token.
+	http.HandleFunc("/metrics", serveMetrics)
 
 	// Start serving REST API forever
+	if tlsClientCaFile != "" && (tlsCertFile == "" || tlsKeyFile == "") {
+		logger.Error("Client certificate authentication requires a TLS certificate and key")
+		os.Exit(1)
+	}
 	if tlsCertFile == "" || tlsKeyFile == "" {
-		log.Printf("INFO Starting unsecured REST API listener on %s\n", httpListenAddr)
-		log.Fatal(http.ListenAndServe(httpListenAddr, nil))
+		logger.Info("Starting unsecured REST API listener", "address", httpListenAddr)
+		err := http.ListenAndServe(httpListenAddr, nil)
+		logger.Error("REST API listener failed", "error", err)
+		os.Exit(1)
 	} else {
-		log.Printf("INFO Starting TLS REST API listener on %s\n", httpListenAddr)
+		logger.Info("Starting TLS REST API listener", "address", httpListenAddr)
 		// tlsCertFile, _ := filepath.Abs(tlsCertFile)
 		// tlsKeyFile, _ := filepath.Abs(tlsKeyFile)
-		log.Fatal(http.ListenAndServeTLS(httpListenAddr, tlsCertFile, tlsKeyFile, nil))
+		server := &http.Server{Addr: httpListenAddr}
+		if tlsClientCaFile != "" {
+			err, tlsConfig := clientCaTlsConfig(tlsClientCaFile)
+			if err != nil {
+				logger.Error("Could not load client CA", "file", tlsClientCaFile, "error", err)
+				os.Exit(1)
+			}
+			logger.Info("Requiring client certificates", "ca_file", tlsClientCaFile)
+			server.TLSConfig = tlsConfig
+		}
+		err := server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		logger.Error("REST API listener failed", "error", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,167 @@
+package yesdns
+
+// Response rate limiting (RRL), modelled on BIND's rate-limit.
+// https://kb.isc.org/docs/aa-00994
+//
+// Every client prefix has a credit account per distinct response. Accounts earn ResponsesPerSecond credits per second
+// and spend one per response. A response is limited when its account is out of credit. Accounts can go into debt
+// up to Window seconds worth of credit, so a client has to slow down for a while before it is served again.
+// Only UDP is limited, because TCP clients can't spoof their source address.
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// What to do with a response
+const (
+	RrlPass = ""
+	// Don't respond
+	RrlDrop = "drop"
+	// Respond with an empty, truncated response so that legitimate clients retry over TCP
+	RrlSlip = "slip"
+)
+
+const (
+	DefaultRrlWindow           = 15
+	DefaultRrlSlip             = 2
+	DefaultRrlIpv4PrefixLength = 24
+	DefaultRrlIpv6PrefixLength = 56
+)
+
+// Resolver.RateLimit. Zero values mean the defaults, except that ResponsesPerSecond 0 disables rate limiting.
+type RateLimit struct {
+	ResponsesPerSecond int `json:"responses_per_second"`
+	// Seconds
+	Window int `json:"window,omitempty"`
+	// Every Slip-th limited response is sent truncated instead of being dropped. Negative means always drop.
+	Slip             int `json:"slip,omitempty"`
+	Ipv4PrefixLength int `json:"ipv4_prefix_length,omitempty"`
+	Ipv6PrefixLength int `json:"ipv6_prefix_length,omitempty"`
+}
+
+type rrlAccount struct {
+	balance float64
+	updated time.Time
+	// Limited responses so far, for slip
+	limited int
+}
+
+var (
+	rrlAccounts      = make(map[string]*rrlAccount)
+	rrlAccountsMutex sync.Mutex
+	rrlLastSweep     time.Time
+)
+
+func (l RateLimit) window() time.Duration {
+	if l.Window <= 0 {
+		return DefaultRrlWindow * time.Second
+	}
+	return time.Duration(l.Window) * time.Second
+}
+
+func (l RateLimit) slip() int {
+	if l.Slip == 0 {
+		return DefaultRrlSlip
+	}
+	return l.Slip
+}
+
+// Masks clientIp down to the configured prefix length
+func (l RateLimit) clientPrefix(clientIp net.IP) string {
+	if ip4 := clientIp.To4(); ip4 != nil {
+		prefixLength := l.Ipv4PrefixLength
+		if prefixLength <= 0 {
+			prefixLength = DefaultRrlIpv4PrefixLength
+		}
+		return ip4.Mask(net.CIDRMask(prefixLength, 32)).String() + "/" + strconv.Itoa(prefixLength)
+	}
+	prefixLength := l.Ipv6PrefixLength
+	if prefixLength <= 0 {
+		prefixLength = DefaultRrlIpv6PrefixLength
+	}
+	return clientIp.Mask(net.CIDRMask(prefixLength, 128)).String() + "/" + strconv.Itoa(prefixLength)
+}
+
+// Identifies a response. Positive answers are distinct per name and type, while all errors of a kind share an
+// account, like BIND's nxdomains-per-second and errors-per-second.
+func rrlResponseKey(requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg) string {
+	rcode := dns.RcodeToString[responseDnsMsg.Rcode]
+	if responseDnsMsg.Rcode != dns.RcodeSuccess || len(requestDnsMsg.Question) == 0 {
+		return rcode
+	}
+	question := requestDnsMsg.Question[0]
+	return rcode + "/" + strings.ToLower(question.Name) + "/" + dns.Type(question.Qtype).String()
+}
+
+// Returns RrlPass, RrlDrop or RrlSlip for a response to a client of resolver.
+func rateLimit(resolver *Resolver, dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg,
+	responseDnsMsg *dns.Msg) string {
+	limit := resolver.RateLimit
+	if limit == nil || limit.ResponsesPerSecond <= 0 {
+		return RrlPass
+	}
+	udpAddr, ok := dnsResponseWriter.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return RrlPass
+	}
+	key := resolver.Id + "/" + limit.clientPrefix(udpAddr.IP) + "/" + rrlResponseKey(requestDnsMsg, responseDnsMsg)
+	rate := float64(limit.ResponsesPerSecond)
+	now := time.Now()
+
+	rrlAccountsMutex.Lock()
+	defer rrlAccountsMutex.Unlock()
+
+	sweepRrlAccounts(now, limit.window())
+	account, ok := rrlAccounts[key]
+	if !ok {
+		account = &rrlAccount{balance: rate, updated: now}
+		rrlAccounts[key] = account
+	}
+	// Earn credit for the time since the last response, but never more than one second's worth
+	account.balance += now.Sub(account.updated).Seconds() * rate
+	if account.balance > rate {
+		account.balance = rate
+	}
+	account.updated = now
+	account.balance--
+	if minBalance := -rate * limit.window().Seconds(); account.balance < minBalance {
+		account.balance = minBalance
+	}
+	if account.balance >= 0 {
+		account.limited = 0
+		return RrlPass
+	}
+	account.limited++
+	if slip := limit.slip(); slip > 0 && account.limited%slip == 0 {
+		return RrlSlip
+	}
+	return RrlDrop
+}
+
+// Forgets accounts that have been idle for longer than window. Must be called with rrlAccountsMutex held.
+func sweepRrlAccounts(now time.Time, window time.Duration) {
+	if now.Sub(rrlLastSweep) < window {
+		return
+	}
+	rrlLastSweep = now
+	for key, account := range rrlAccounts {
+		if now.Sub(account.updated) > window {
+			delete(rrlAccounts, key)
+		}
+	}
+}
+
+// Empty, truncated response that tells the client to retry over TCP
+func slipResponse(requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg) *dns.Msg {
+	slipDnsMsg := new(dns.Msg)
+	slipDnsMsg.SetReply(requestDnsMsg)
+	slipDnsMsg.Rcode = responseDnsMsg.Rcode
+	slipDnsMsg.Truncated = true
+	return slipDnsMsg
+}
@@ -0,0 +1,67 @@
+package yesdns
+
+// Ordering of RRs within RRsets in the Answer section, like BIND's rrset-order.
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Values for DnsMessage.RrsetOrder
+const (
+	// Always the stored order. The default.
+	RrsetOrderFixed = "fixed"
+	// Shuffle on every query
+	RrsetOrderRandom = "random"
+	// Rotate by one on every query
+	RrsetOrderCyclic = "cyclic"
+)
+
+// Counter of cyclic rotations of the DnsMessage whose responseCounterKey() is key
+func rrsetOrderCounterKey(key string) string {
+	return key + "/rrset-order"
+}
+
+// Reorders the RRs of each RRset (RRs with the same name and type) in place. RRsets stay where they are in the
+// section, only their members change places. key is the responseCounterKey() of the stored DnsMessage, so all
+// names answered by one wildcard share a rotation.
+func orderRrsets(rrs []dns.RR, order string, key string) {
+	if order != RrsetOrderRandom && order != RrsetOrderCyclic {
+		return
+	}
+	// Positions of each RRset's members in rrs
+	var rrsetKeys []string
+	positions := make(map[string][]int)
+	for i, rr := range rrs {
+		rrsetKey := strings.ToLower(rr.Header().Name) + "/" + dns.Type(rr.Header().Rrtype).String()
+		if _, ok := positions[rrsetKey]; !ok {
+			rrsetKeys = append(rrsetKeys, rrsetKey)
+		}
+		positions[rrsetKey] = append(positions[rrsetKey], i)
+	}
+	var rotation int
+	if order == RrsetOrderCyclic {
+		rotation = nextResponseCount(rrsetOrderCounterKey(key))
+	}
+	for _, rrsetKey := range rrsetKeys {
+		indexes := positions[rrsetKey]
+		if len(indexes) < 2 {
+			continue
+		}
+		members := make([]dns.RR, len(indexes))
+		for i, index := range indexes {
+			members[i] = rrs[index]
+		}
+		if order == RrsetOrderRandom {
+			rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+		} else {
+			shift := rotation % len(members)
+			members = append(members[shift:], members[:shift]...)
+		}
+		for i, index := range indexes {
+			rrs[index] = members[i]
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package yesdns
+
+// Secondary zones, copied from a primary server with AXFR (RFC 5936) and kept up to date following the timers in
+// the zone's SOA (RFC 1034 section 4.3.5) and NOTIFY (RFC 1996).
+// Transferred records are stored as DnsMessages under their own storage id (see secondaryStorageId), so DnsMessages
+// written via /v1/question override them and survive refreshes.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const secondaryZonesCollection = "secondary-zones"
+
+const (
+	// How long to wait for the primary to answer a SOA query
+	secondaryTimeout = 5 * time.Second
+	// How soon to retry if a zone was never transferred. Afterwards the SOA's retry timer is used.
+	secondaryInitialRetry = 10 * time.Second
+	// Lower bound for SOA timers, so a bad SOA can't make us hammer the primary
+	secondaryMinInterval = 5 * time.Second
+)
+
+// Makes a zone a secondary of another server
+type ZonePrimary struct {
+	// Primary server as host:port. The port defaults to 53.
+	Address string `json:"address"`
+	// Signs SOA queries and transfers. A key with only a name refers to a managed key.
+	TsigKey *TsigKey `json:"tsig_key,omitempty"`
+}
+
+// State of a secondary zone as stored in the Database
+type SecondaryZone struct {
+	Resolver string `json:"resolver"`
+	Zone     string `json:"zone"`
+	// Serial of the last transfer
+	Serial        uint32    `json:"serial"`
+	TransferredAt time.Time `json:"transferred_at"`
+	// Last time the primary confirmed the serial
+	RefreshedAt time.Time `json:"refreshed_at"`
+	// The zone is no longer served after this, unless the primary confirms the serial again
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Transferred DnsMessages of a zone are stored as if they belonged to a resolver named resolverId#zone
+func secondaryStorageId(resolverId string, zone string) string {
+	return zoneResource(resolverId, zone)
+}
+
+func (d Database) readSecondaryZone(resolverId string, zone string) (error, *SecondaryZone) {
+	secondaryZone := SecondaryZone{}
+	err := d.db.Read(secondaryZonesCollection, zoneResource(resolverId, zone), &secondaryZone)
+	return err, &secondaryZone
+}
+
+func (d Database) writeSecondaryZone(secondaryZone SecondaryZone) error {
+	return d.db.Write(secondaryZonesCollection, zoneResource(secondaryZone.Resolver, secondaryZone.Zone), secondaryZone)
+}
+
+func (d Database) deleteSecondaryZone(resolverId string, zone string) error {
+	return d.db.Delete(secondaryZonesCollection, zoneResource(resolverId, zone))
+}
+
+func (d Database) readAllSecondaryZones() (error, []SecondaryZone) {
+	jsonStrings, err := d.db.ReadAll(secondaryZonesCollection)
+	if err != nil {
+		return err, nil
+	}
+	var secondaryZones []SecondaryZone
+	for _, jsonString := range jsonStrings {
+		var secondaryZone SecondaryZone
+		if err := json.NewDecoder(bytes.NewBufferString(jsonString)).Decode(&secondaryZone); err != nil {
+			logger.Warn("Could not decode secondary zone", "error", err)
+		} else {
+			secondaryZones = append(secondaryZones, secondaryZone)
+		}
+	}
+	return nil, secondaryZones
+}
+
+func (p ZonePrimary) address() string {
+	if _, _, err := net.SplitHostPort(p.Address); err != nil {
+		return net.JoinHostPort(p.Address, "53")
+	}
+	return p.Address
+}
+
+// Returns the TSIG key to sign requests to the primary with, or nil if there is none
+func (p ZonePrimary) tsigKey() *TsigKey {
+	if p.TsigKey == nil {
+		return nil
+	}
+	return resolveTsigKey(*p.TsigKey)
+}
+
+// True if a NOTIFY came from the primary, by address or by TSIG key. resource is the zoneResource of the secondary
+// zone, tsigKey is the key the NOTIFY was signed with, or nil. Addresses are compared against the ones the zone's
+// refresher resolved, so NOTIFY never waits for a DNS lookup.
+func (p ZonePrimary) sentBy(resource string, clientIp net.IP, tsigKey *TsigKey) bool {
+	if tsigKey != nil && p.TsigKey != nil && tsigKey.canonicalName() == p.TsigKey.canonicalName() {
+		return true
+	}
+	if clientIp == nil {
+		return false
+	}
+	primaryIps.Lock()
+	resolved, ok := primaryIps.byResource[resource]
+	primaryIps.Unlock()
+	// The primary may have changed since it was resolved
+	if !ok || resolved.address != p.address() {
+		return false
+	}
+	for _, ip := range resolved.ips {
+		if ip.Equal(clientIp) {
+			return true
+		}
+	}
+	return false
+}
+
+// IP addresses of the primaries of secondary zones, by zoneResource
+var primaryIps = struct {
+	sync.Mutex
+	byResource map[string]resolvedPrimary
+}{byResource: make(map[string]resolvedPrimary)}
+
+type resolvedPrimary struct {
+	// Primary address (host:port) the ips were resolved from
+	address string
+	ips     []net.IP
+}
+
+// Looks up the IP addresses of the primary of the refresher's zone. If the lookup fails, the addresses resolved
+// before are kept as long as the primary is the same.
+func (s *secondaryRefresher) resolvePrimary(primary ZonePrimary) {
+	resource := zoneResource(s.resolverId, s.apex)
+	address := primary.address()
+	host, _, err := net.SplitHostPort(address)
+	var ips []net.IP
+	if err == nil {
+		ips, err = net.LookupIP(host)
+	}
+	primaryIps.Lock()
+	defer primaryIps.Unlock()
+	if err != nil {
+		logger.Warn("Could not resolve primary", "resolver", s.resolverId, "zone", s.apex, "primary", primary.Address,
+			"error", err)
+		if primaryIps.byResource[resource].address != address {
+			delete(primaryIps.byResource, resource)
+		}
+		return
+	}
+	primaryIps.byResource[resource] = resolvedPrimary{address: address, ips: ips}
+}
+
+// True if the primary of the secondary zone resource was not resolved yet, or has changed since
+func primaryUnresolved(resource string, primary ZonePrimary) bool {
+	primaryIps.Lock()
+	defer primaryIps.Unlock()
+	resolved, ok := primaryIps.byResource[resource]
+	return !ok || resolved.address != primary.address()
+}
+
+// Signs requestDnsMsg with key, if there is one, and returns the secrets a client needs to verify the response
+func signRequest(requestDnsMsg *dns.Msg, key *TsigKey) map[string]string {
+	if key == nil {
+		return nil
+	}
+	requestDnsMsg.SetTsig(key.canonicalName(), key.canonicalAlgorithm(), tsigFudge, time.Now().Unix())
+	return map[string]string{key.canonicalName(): key.Secret}
+}
+
+// Asks the primary for the SOA of zone
+func (p ZonePrimary) querySoa(zone Zone) (error, *dns.SOA) {
+	requestDnsMsg := new(dns.Msg)
+	requestDnsMsg.SetQuestion(dns.Fqdn(zone.Apex), dns.TypeSOA)
+	client := dns.Client{Timeout: secondaryTimeout}
+	client.TsigSecret = signRequest(requestDnsMsg, p.tsigKey())
+	responseDnsMsg, _, err := client.Exchange(requestDnsMsg, p.address())
+	if err != nil {
+		return err, nil
+	}
+	if responseDnsMsg.Rcode != dns.RcodeSuccess || !responseDnsMsg.Authoritative {
+		return errors.New(fmt.Sprintf("Primary answered SOA query with %s, authoritative %t",
+			dns.RcodeToString[responseDnsMsg.Rcode], responseDnsMsg.Authoritative)), nil
+	}
+	for _, rr := range responseDnsMsg.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return nil, soa
+		}
+	}
+	return errors.New("Primary sent no SOA"), nil
+}
+
+// Transfers zone from the primary with AXFR. Returns the zone's SOA and its other RRs.
+func (p ZonePrimary) transfer(zone Zone) (error, *dns.SOA, []dns.RR) {
+	requestDnsMsg := new(dns.Msg)
+	requestDnsMsg.SetAxfr(dns.Fqdn(zone.Apex))
+	transfer := new(dns.Transfer)
+	transfer.TsigSecret = signRequest(requestDnsMsg, p.tsigKey())
+	envelopes, err := transfer.In(requestDnsMsg, p.address())
+	if err != nil {
+		return err, nil, nil
+	}
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return envelope.Error, nil, nil
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	// A transfer starts and ends with the SOA
+	if len(rrs) < 2 {
+		return errors.New("Zone transfer is incomplete"), nil, nil
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("Zone transfer does not start with SOA"), nil, nil
+	}
+	if _, ok := rrs[len(rrs)-1].(*dns.SOA); !ok {
+		return errors.New("Zone transfer does not end with SOA"), nil, nil
+	}
+	return nil, soa, rrs[1 : len(rrs)-1]
+}
+
+// Storage ids that hold the DnsMessages of zone, most specific first. Views are not included.
+func (r Resolver) zoneStorageIds(zone Zone) []string {
+	if zone.Primary != nil {
+		return []string{r.Id, secondaryStorageId(r.Id, zone.Apex)}
+	}
+	return []string{r.Id}
+}
+
+// Returns the storage id of transferred DnsMessages for name, or "" if name is not in a secondary zone
+func (r Resolver) secondaryStorageIdFor(name string) string {
+	if zone := r.zoneFor(name); zone != nil && zone.Primary != nil {
+		return secondaryStorageId(r.Id, zone.Apex)
+	}
+	return ""
+}
+
+// False if zone is a secondary zone that was never transferred or has expired
+func (r Resolver) zoneServable(zone Zone) bool {
+	if zone.Primary == nil {
+		return true
+	}
+	err, secondaryZone := r.Database.readSecondaryZone(r.Id, zone.Apex)
+	return err == nil && time.Now().Before(secondaryZone.ExpiresAt)
+}
+
+// Replaces the transferred DnsMessages of zone with soa and rrs. RRs of types we can't serve are left out.
+func (r Resolver) storeSecondaryZone(zone Zone, soa *dns.SOA, rrs []dns.RR) error {
+	storageId := secondaryStorageId(r.Id, zone.Apex)
+	var keys []string
+	dnsMessages := make(map[string]*DnsMessage)
+	skipped := 0
+	for _, rr := range append([]dns.RR{soa}, rrs...) {
+		err, rrSection := dnsRRFromRR(rr)
+		if err != nil {
+			skipped++
+			continue
+		}
+		header := rr.Header()
+		qname := header.Name
+		key := fmt.Sprintf("%s/%d", qname, header.Rrtype)
+		if _, ok := dnsMessages[key]; !ok {
+			keys = append(keys, key)
+			dnsMessages[key] = &DnsMessage{
+				Resolvers: []string{r.Id},
+				MsgHdr:    DnsHeader{Authoritative: true},
+				Question:  []DnsQuestion{{Qname: qname, Qtype: header.Rrtype, Qclass: header.Class}},
+			}
+		}
+		dnsMessages[key].Answer = append(dnsMessages[key].Answer, rrSection)
+	}
+	if skipped > 0 {
+		logger.Info("Left out RRs of unsupported types from secondary zone", "resolver", r.Id, "zone", zone.Apex,
+			"rrs", skipped)
+	}
+
+	// Don't mix up with journaled writes
+	zoneJournalLock.Lock()
+	defer zoneJournalLock.Unlock()
+	servedSerial := r.zoneSoa(zone).Serial
+	for _, key := range keys {
+		if err := r.Database.writeStoredDnsMessage(storageId, *dnsMessages[key]); err != nil {
+			return err
+		}
+	}
+	for _, qtype := range r.Database.storedQtypes(storageId) {
+		for _, qname := range r.Database.storedQnames(storageId, qtype) {
+			if _, ok := dnsMessages[fmt.Sprintf("%s/%d", qname, qtype)]; !ok {
+				r.Database.deleteResolverDnsMessage(storageId, qtype, qname)
+			}
+		}
+	}
+	// The journal doesn't have the changes from the primary, so our own secondaries need a full transfer.
+	// Overrides may have bumped the serial we serve past the primary's, and it must not go back.
+	if serialNewer(soa.Serial, servedSerial) {
+		// Not finding a journal is not an error
+		r.Database.deleteZoneJournal(r.Id, zone.Apex)
+		return nil
+	}
+	return r.Database.writeZoneJournal(ZoneJournal{Resolver: r.Id, Zone: zone.canonicalApex(), Serial: servedSerial + 1})
+}
+
+// Refreshers of all secondary zones, by zoneResource
+var secondaryRefreshers = struct {
+	sync.Mutex
+	byResource map[string]*secondaryRefresher
+}{byResource: make(map[string]*secondaryRefresher)}
+
+// Keeps one secondary zone up to date, in the background
+type secondaryRefresher struct {
+	resolverId string
+	apex       string
+	// Wakes the refresher up early, e.g. on NOTIFY
+	wakeUp chan bool
+	stop   chan bool
+}
+
+// Starts refreshers for new secondary zones, and stops the ones of zones that are gone
+func syncSecondaries(database *Database, configuredResolvers []*Resolver) {
+	secondaryRefreshers.Lock()
+	defer secondaryRefreshers.Unlock()
+	configured := make(map[string]bool)
+	for _, resolver := range configuredResolvers {
+		for _, zone := range resolver.Zones {
+			if zone.Primary == nil {
+				continue
+			}
+			resource := zoneResource(resolver.Id, zone.Apex)
+			configured[resource] = true
+			if refresher, ok := secondaryRefreshers.byResource[resource]; ok {
+				// Resolve a changed primary now, not at the next refresh
+				if primaryUnresolved(resource, *zone.Primary) {
+					refresher.wakeUpNow()
+				}
+				continue
+			}
+			refresher := &secondaryRefresher{
+				resolverId: resolver.Id,
+				apex:       zone.canonicalApex(),
+				wakeUp:     make(chan bool, 1),
+				stop:       make(chan bool),
+			}
+			secondaryRefreshers.byResource[resource] = refresher
+			go refresher.run(database)
+		}
+	}
+	for resource, refresher := range secondaryRefreshers.byResource {
+		if !configured[resource] {
+			close(refresher.stop)
+			delete(secondaryRefreshers.byResource, resource)
+			primaryIps.Lock()
+			delete(primaryIps.byResource, resource)
+			primaryIps.Unlock()
+		}
+	}
+}
+
+// Makes the refresher of a secondary zone check the primary now
+func wakeUpSecondary(resolverId string, zone string) {
+	secondaryRefreshers.Lock()
+	defer secondaryRefreshers.Unlock()
+	if refresher, ok := secondaryRefreshers.byResource[zoneResource(resolverId, zone)]; ok {
+		refresher.wakeUpNow()
+	}
+}
+
+func (s *secondaryRefresher) wakeUpNow() {
+	select {
+	case s.wakeUp <- true:
+	default:
+		// Already awake
+	}
+}
+
+func (s *secondaryRefresher) run(database *Database) {
+	logger.Debug("Starting secondary zone refresher", "resolver", s.resolverId, "zone", s.apex)
+	for {
+		wait := s.refresh(database)
+		select {
+		case <-s.stop:
+			logger.Debug("Stopping secondary zone refresher", "resolver", s.resolverId, "zone", s.apex)
+			return
+		case <-s.wakeUp:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Checks the serial at the primary and transfers the zone if it changed. Returns when to check again.
+func (s *secondaryRefresher) refresh(database *Database) time.Duration {
+	currentResolvers.RLock()
+	resolver, ok := currentResolvers.byId[s.resolverId]
+	currentResolvers.RUnlock()
+	if !ok {
+		return secondaryInitialRetry
+	}
+	zone := resolver.zoneFor(s.apex)
+	if zone == nil || zone.canonicalApex() != s.apex || zone.Primary == nil {
+		return secondaryInitialRetry
+	}
+	s.resolvePrimary(*zone.Primary)
+	err, secondaryZone := database.readSecondaryZone(s.resolverId, s.apex)
+	transferred := err == nil
+	retry := secondaryInitialRetry
+	if transferred {
+		retry = secondsInterval(resolver.storedZoneSoa(*zone).Retry)
+	}
+
+	err, primarySoa := zone.Primary.querySoa(*zone)
+	if err != nil {
+		logger.Warn("Could not get SOA from primary", "resolver", s.resolverId, "zone", s.apex,
+			"primary", zone.Primary.Address, "error", err)
+		return retry
+	}
+	now := time.Now().UTC()
+	if transferred && !serialNewer(primarySoa.Serial, secondaryZone.Serial) {
+		logger.Debug("Secondary zone is up to date", "resolver", s.resolverId, "zone", s.apex, "serial", secondaryZone.Serial)
+	} else {
+		err, soa, rrs := zone.Primary.transfer(*zone)
+		if err == nil {
+			err = resolver.storeSecondaryZone(*zone, soa, rrs)
+		}
+		if err != nil {
+			logger.Warn("Could not transfer zone from primary", "resolver", s.resolverId, "zone", s.apex,
+				"primary", zone.Primary.Address, "error", err)
+			return retry
+		}
+		logger.Info("Transferred zone from primary", "resolver", s.resolverId, "zone", s.apex,
+			"primary", zone.Primary.Address, "serial", soa.Serial, "rrs", len(rrs))
+		primarySoa = soa
+		secondaryZone = &SecondaryZone{Resolver: s.resolverId, Zone: s.apex, Serial: soa.Serial, TransferredAt: now}
+		resolver.notifySecondaries(*zone, resolver.zoneSoa(*zone))
+	}
+	secondaryZone.RefreshedAt = now
+	secondaryZone.ExpiresAt = now.Add(time.Duration(primarySoa.Expire) * time.Second)
+	if err := database.writeSecondaryZone(*secondaryZone); err != nil {
+		logger.Error("Could not write secondary zone", "resolver", s.resolverId, "zone", s.apex, "error", err)
+		return retry
+	}
+	return secondsInterval(primarySoa.Refresh)
+}
+
+func secondsInterval(seconds uint32) time.Duration {
+	interval := time.Duration(seconds) * time.Second
+	if interval < secondaryMinInterval {
+		return secondaryMinInterval
+	}
+	return interval
+}
+
+// Answers a NOTIFY for the apex of one of the resolver's secondary zones, and makes it check the primary.
+// Only accepts NOTIFY from the primary. tsigKey is the key the request was signed with, or nil.
+func (r Resolver) notifyIn(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, listener ResolverListener,
+	tsigKey *TsigKey, clientIp net.IP) {
+	question := requestDnsMsg.Question[0]
+	responseDnsMsg := new(dns.Msg)
+	zone := r.zoneFor(question.Name)
+	if zone == nil || zone.canonicalApex() != dns.CanonicalName(question.Name) || zone.Primary == nil {
+		logger.Debug("Refusing NOTIFY for unknown zone", "resolver", r.Id, "zone", question.Name)
+		responseDnsMsg.SetRcode(requestDnsMsg, dns.RcodeNotAuth)
+	} else if !zone.Primary.sentBy(zoneResource(r.Id, zone.Apex), clientIp, tsigKey) {
+		logger.Info("Refusing NOTIFY from other than primary", "resolver", r.Id, "zone", zone.Apex,
+			"client", clientIp.String())
+		responseDnsMsg.SetRcode(requestDnsMsg, dns.RcodeRefused)
+	} else {
+		logger.Debug("Received NOTIFY", "resolver", r.Id, "zone", zone.Apex, "client", clientIp.String())
+		responseDnsMsg.SetReply(requestDnsMsg)
+		responseDnsMsg.Authoritative = true
+		wakeUpSecondary(r.Id, zone.Apex)
+	}
+	if tsigKey != nil {
+		signResponse(responseDnsMsg, tsigKey)
+	}
+	answeredBy := AnsweredByNone
+	if responseDnsMsg.Rcode == dns.RcodeSuccess {
+		answeredBy = AnsweredByZone
+	}
+	writeResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, &r, listener, answeredBy, "")
+}
+
+// Returns an error if a zone apex is not a valid zone name, or a secondary zone has no usable primary
+func (r Resolver) validateZones() error {
+	for _, zone := range r.Zones {
+		if err := validateZoneName(zone.Apex); err != nil {
+			return err
+		}
+		if zone.Primary == nil {
+			continue
+		}
+		if zone.Primary.Address == "" {
+			return errors.New(fmt.Sprintf("Primary of zone %s has no address", zone.Apex))
+		}
+		if key := zone.Primary.TsigKey; key != nil && !(key.Secret == "" && key.Algorithm == "" && key.Name != "") {
+			if err := key.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
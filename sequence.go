@@ -0,0 +1,129 @@
+package yesdns
+
+// Lets a single question hold a list of responses that are served in sequence, round-robin or by weighted random.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Values for DnsMessage.Selection
+const (
+	// Serve responses in order. Stick at the last one unless DnsMessage.Loop is set.
+	SelectionSequence = "sequence"
+	// Serve responses in order, starting over after the last one
+	SelectionRoundRobin = "round_robin"
+	// Pick a response at random, proportionally to DnsResponse.Weight
+	SelectionWeighted = "weighted"
+)
+
+// One of several possible responses to a question
+type DnsResponse struct {
+	MsgHdr DnsHeader `json:"header"`
+	Answer []DnsRR   `json:"answer"`
+	Ns     []DnsRR   `json:"ns"`
+	Extra  []DnsRR   `json:"extra"`
+	// Number of consecutive times this response is served in sequence and round_robin selection. Defaults to 1.
+	Repeat int `json:"repeat,omitempty"`
+	// Relative weight in weighted selection. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// Returns an error if m.Selection is not one of the Selection* constants, or empty.
+func (m DnsMessage) validateSelection() error {
+	switch m.Selection {
+	case "", SelectionSequence, SelectionRoundRobin, SelectionWeighted:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Unknown selection '%s'. Must be one of %s, %s or %s", m.Selection,
+		SelectionSequence, SelectionRoundRobin, SelectionWeighted))
+}
+
+// Number of times each question has been answered, indexed by responseCounterKey()
+var responseCounters = struct {
+	sync.Mutex
+	byKey map[string]int
+}{byKey: make(map[string]int)}
+
+func responseCounterKey(resolverId string, qtype uint16, qname string) string {
+	return dnsMessageKey(resolverId, qtype) + "/" + qname
+}
+
+// Returns how many times key has been answered before, and counts this time.
+func nextResponseCount(key string) int {
+	responseCounters.Lock()
+	defer responseCounters.Unlock()
+	count := responseCounters.byKey[key]
+	responseCounters.byKey[key] = count + 1
+	return count
+}
+
+// Starts the sequence and the cyclic rrset order over, e.g. because the DnsMessage was replaced.
+func resetResponseCount(key string) {
+	responseCounters.Lock()
+	delete(responseCounters.byKey, key)
+	delete(responseCounters.byKey, rrsetOrderCounterKey(key))
+	responseCounters.Unlock()
+}
+
+// Replaces the header and sections of m with the ones from the selected entry in m.Responses.
+// Does nothing if m has no Responses.
+func (m *DnsMessage) selectResponse(key string) {
+	if len(m.Responses) == 0 {
+		return
+	}
+	var selected DnsResponse
+	if m.Selection == SelectionWeighted {
+		selected = weightedResponse(m.Responses)
+	} else {
+		selected = sequencedResponse(m.Responses, nextResponseCount(key), m.Loop || m.Selection == SelectionRoundRobin)
+	}
+	m.MsgHdr = selected.MsgHdr
+	m.Answer = selected.Answer
+	m.Ns = selected.Ns
+	m.Extra = selected.Extra
+}
+
+// Returns the response for the count'th (0 based) query
+func sequencedResponse(responses []DnsResponse, count int, loop bool) DnsResponse {
+	total := 0
+	for _, response := range responses {
+		total += atLeastOne(response.Repeat)
+	}
+	if loop {
+		count = count % total
+	} else if count >= total {
+		return responses[len(responses)-1]
+	}
+	for _, response := range responses {
+		count -= atLeastOne(response.Repeat)
+		if count < 0 {
+			return response
+		}
+	}
+	return responses[len(responses)-1]
+}
+
+func weightedResponse(responses []DnsResponse) DnsResponse {
+	total := 0
+	for _, response := range responses {
+		total += atLeastOne(response.Weight)
+	}
+	draw := rand.Intn(total)
+	for _, response := range responses {
+		draw -= atLeastOne(response.Weight)
+		if draw < 0 {
+			return response
+		}
+	}
+	return responses[len(responses)-1]
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
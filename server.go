@@ -23,7 +23,6 @@ func (s ServerState) HasPattern(pattern string) bool {
 	return false
 }
 
-// TODO support in rest api: go serveDns(listener.Net, listener.Address, tsigName, tsigSecret)
 // TODO should probably return a pointer
 func NewServer(db *Database, configuredResolver *Resolver, listener ResolverListener) *ServerState {
 	// Each listener (protocol+interface+port combo) has its own ServeMux, and hence its
@@ -32,7 +31,7 @@ func NewServer(db *Database, configuredResolver *Resolver, listener ResolverList
 	// var patterns []string
 	for _, configuredPattern := range configuredResolver.Patterns {
 		// Register a handler for pattern
-		serveMux.HandleFunc(configuredPattern, handleDnsQuery(db, configuredResolver))
+		serveMux.HandleFunc(configuredPattern, handleDnsQuery(db, configuredResolver, listener))
 		// patterns = append(patterns, configuredPattern)
 		// Record that this listener+pattern combo was in the configuration
 		// keptListenerPatternKeys = append(keptListenerPatternKeys, listenerPatternKey(listener.Key(), configuredPattern))
@@ -40,7 +39,7 @@ func NewServer(db *Database, configuredResolver *Resolver, listener ResolverList
 	
 	// Start up DNS listeners
 	shutdownChannel := make(chan int)
-	go serveDns(listener.Net, listener.Address, "", "", serveMux, shutdownChannel)
+	go serveDns(listener.Net, listener.Address, tsigKeyProvider{listenerKey: listener.Key()}, serveMux, shutdownChannel)
 	
 	return &ServerState{ ShutdownChannel:shutdownChannel, ServeMux:serveMux, Patterns:configuredResolver.Patterns, Listener: listener, Resolver: configuredResolver }
 }
\ No newline at end of file
@@ -7,7 +7,7 @@ package yesdns
 // server.go
 // listener.go
 import (
-	"log"
+	"sync"
 )
 
 func listenerPatternKey(listenerKey string, pattern string) string {
@@ -31,14 +31,8 @@ func addServers(runningServers map[string]*ServerState, db *Database, configured
 			// This block ensures that there is a Server running for every resolver configured in the db
 			if ok { // Server is already running
 				
-				// Update running DNS server with fresh Forwarder config from the db
-				// NOTE: We can not currently do runningServer.Resolver = configuredResolver because handleDnsQuery
-				//       holds a reference to the original configuredResolver it was created with.
-				// 		 If we ever want to reload the entire Resolver config, we will need to pass a reference to
-				// 		 ServerState to handleDnsQuery callback.
-				log.Printf("DEBUG Forwarders for resolver %s listener %s were: %s, will be %s\n",
-					runningServer.Resolver.Id, listener.Key(), runningServer.Resolver.Forwarders, configuredResolver.Forwarders)
-				runningServer.Resolver.Forwarders = configuredResolver.Forwarders
+				// NOTE: Running handlers pick up fresh Resolver config from the db via currentResolver(),
+				//       so we only have to take care of patterns here.
 				
 				// Make sure there is a handler attached to each server/listener for each pattern.
 				for _, configuredPattern := range configuredResolver.Patterns {
@@ -47,20 +41,19 @@ func addServers(runningServers map[string]*ServerState, db *Database, configured
 					// Otherwise, create new handler and register pattern with running server.
 					if inRunningListener := runningServer.HasPattern(configuredPattern); inRunningListener {
 						// Listener for pattern is already registered with DNS server
-						log.Printf("DEBUG Pattern %s already registered on listener %s\n",
-							configuredPattern, listener.Key())
+						logger.Debug("Pattern already registered", "pattern", configuredPattern, "listener", listener.Key())
 						// Record that this listener+pattern combo was in the configuration
 						keptListenerPatternKeys = append(keptListenerPatternKeys, listenerPatternKey(listener.Key(), configuredPattern))
 					} else {
 						// There is already a running dns.Server for this listener, so just add query handler.
-						log.Printf("DEBUG Adding pattern (%s) to running server %s\n",
-							configuredResolver.Patterns, runningServer)
+						logger.Debug("Adding patterns to running server", "patterns", configuredResolver.Patterns,
+							"listener", listener.Key())
 						// Update handlers to serve configuredResolver.Pattern
 						for _, configuredPattern := range configuredResolver.Patterns {
-							runningServer.ServeMux.HandleFunc(configuredPattern, handleDnsQuery(db, configuredResolver))
+							runningServer.ServeMux.HandleFunc(configuredPattern, handleDnsQuery(db, configuredResolver, listener))
 							// Add this pattern to the list of patterns this server will handle
 							runningServer.Patterns = append(runningServer.Patterns, configuredPattern)
-							log.Printf("DEBUG After addition, patterns are: %s\n", runningServer.Patterns)
+							logger.Debug("After addition", "patterns", runningServer.Patterns)
 							runningServers[listener.Key()] = runningServer
 							// Record that this listener+pattern combo was in the configuration
 							keptListenerPatternKeys = append(keptListenerPatternKeys, listenerPatternKey(listener.Key(), configuredPattern))
@@ -68,15 +61,14 @@ func addServers(runningServers map[string]*ServerState, db *Database, configured
 					}
 				}
 			} else { // Server/Listener is not already running
-				log.Printf("INFO Starting new server on %s with pattern '%s'\n", listener, configuredResolver.Patterns)
+				logger.Info("Starting new server", "listener", listener.Key(), "patterns", configuredResolver.Patterns)
 				// Start up a new server and save a reference to it
 				runningServers[listener.Key()] = NewServer(db, configuredResolver, listener)
 				// Record the listener+pattern combos we kept
 				for _, configuredPattern := range configuredResolver.Patterns {
 					keptListenerPatternKeys = append(keptListenerPatternKeys, listenerPatternKey(listener.Key(), configuredPattern))
 				}
-				log.Printf("DEBUG Added running server %s with listener key %s and patterns %s\n",
-					runningServers[listener.Key()], listener.Key(), configuredResolver.Patterns)
+				logger.Debug("Added running server", "listener", listener.Key(), "patterns", configuredResolver.Patterns)
 			}
 		}
 	}
@@ -87,7 +79,7 @@ func addServers(runningServers map[string]*ServerState, db *Database, configured
 func cleanUpServers(runningServers map[string]*ServerState, keptListenerPatternKeys []string) {
 	// Stop all running DNS servers, or just remove patterns from them, that were not in configuration this time
 	for listenerKey, runningServer := range runningServers {
-		log.Printf("DEBUG Before removals, patterns are: %s\n", runningServer.Patterns)
+		logger.Debug("Before removals", "listener", listenerKey, "patterns", runningServer.Patterns)
 		
 		// If listenerKey not in keptKeys, remove pattern from listener
 		// https://play.golang.org/p/YSG7q7uQgv
@@ -97,30 +89,30 @@ func cleanUpServers(runningServers map[string]*ServerState, keptListenerPatternK
 			runningKey := listenerPatternKey(listenerKey, pattern)
 			inKeptKeys := false
 			for _, keptKey := range keptListenerPatternKeys {
-				log.Printf("DEBUG Comparing kept key '%s' == running key '%s'\n", keptKey, runningKey)
+				logger.Debug("Comparing kept key to running key", "kept_key", keptKey, "running_key", runningKey)
 				if keptKey == runningKey {
-					log.Printf("DEBUG Keeping %s\n", keptKey)
+					logger.Debug("Keeping", "kept_key", keptKey)
 					inKeptKeys = true
 				}
 			}
 			// Listener+pattern combo not in keptKeys, so remove it
 			if ! inKeptKeys {
-				log.Printf("DEBUG Removing pattern %s from running server %s\n", pattern, listenerKey)
+				logger.Debug("Removing pattern from running server", "pattern", pattern, "listener", listenerKey)
 				// Remove pattern from our list if active patterns
 				runningServer.ServeMux.HandleRemove(pattern)
 			} else {
-				log.Printf("DEBUG Retaining pattern %s in position %s\n", runningServer.Patterns[i], j)
+				logger.Debug("Retaining pattern", "pattern", runningServer.Patterns[i], "position", j)
 				runningServer.Patterns[j] = runningServer.Patterns[i]
 				j++
 			}
 		}
 		// Trim unwanted items off of slice
 		runningServer.Patterns = runningServer.Patterns[:j]
-		log.Printf("DEBUG After removal, patterns are: %s\n", runningServer.Patterns)
+		logger.Debug("After removal", "listener", listenerKey, "patterns", runningServer.Patterns)
 
 		// If there are no more patterns assigned, stop server
 		if len(runningServer.Patterns) == 0 {
-			log.Printf("INFO Stopping server: %s\n", listenerKey)
+			logger.Info("Stopping server", "listener", listenerKey)
 			runningServer.ShutdownChannel <- 0
 			// Remove runningResolverKey from runningResolvers
 			delete(runningServers, listenerKey)
@@ -128,6 +120,32 @@ func cleanUpServers(runningServers map[string]*ServerState, keptListenerPatternK
 	}
 }
 
+// Latest configuration of every resolver, indexed by Resolver.Id. Replaced on every reload.
+var currentResolvers = struct {
+	sync.RWMutex
+	byId map[string]*Resolver
+}{byId: make(map[string]*Resolver)}
+
+func setCurrentResolvers(configuredResolvers []*Resolver) {
+	byId := make(map[string]*Resolver)
+	for _, configuredResolver := range configuredResolvers {
+		byId[configuredResolver.Id] = configuredResolver
+	}
+	currentResolvers.Lock()
+	currentResolvers.byId = byId
+	currentResolvers.Unlock()
+}
+
+// Returns the latest configuration for resolver, or resolver itself if it is no longer configured.
+func currentResolver(resolver *Resolver) *Resolver {
+	currentResolvers.RLock()
+	defer currentResolvers.RUnlock()
+	if current, ok := currentResolvers.byId[resolver.Id]; ok {
+		return current
+	}
+	return resolver
+}
+
 // Starts and stops resolvers based on config in database.
 // Maps are a 'reference type', so even though we appear to pass by value, we really just get a reference.
 // Uses global variable RunningDNSServers.
@@ -137,13 +155,17 @@ func SyncServersWithDatabase(db *Database, reloadChannel chan bool) {
 	runningServers := make(map[string]*ServerState)
 	
 	for {
-		log.Printf("DEBUG Reloading DNS servers from database\n")
+		logger.Debug("Reloading DNS servers from database")
 		
+		db.loadTsigKeys()
 		if err, configuredResolvers := db.ReadAllResolvers(); err != nil {
-			log.Printf("WARN Could not load any resolvers because: %s\n", err)
+			logger.Warn("Could not load any resolvers", "error", err)
 		} else {
+			setCurrentResolvers(configuredResolvers)
+			syncSecondaries(db, configuredResolvers)
 			keptListenerPatternKeys := addServers(runningServers, db, configuredResolvers)
 			cleanUpServers(runningServers, keptListenerPatternKeys)
+			updateRunningListenersMetric(runningServers)
 		}
 		
 		// Block and wait for signal on reload channel
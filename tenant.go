@@ -0,0 +1,106 @@
+package yesdns
+
+// Multi-tenancy. Resolvers can belong to a tenant, and API clients (tokens or client certificates) can be scoped to
+// a tenant. Clients scoped to a tenant can only write to that tenant's resolvers and their DnsMessages.
+// Resolvers of different tenants may not share listeners.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// True if every principal of r that is scoped to a tenant is scoped to tenant
+func principalsAllowTenant(r *http.Request, tenant string) bool {
+	for _, principal := range requestPrincipals(r) {
+		if principal.Tenant != "" && principal.Tenant != tenant {
+			logger.Info("Principal not allowed to write tenant", "principal", principal.Name,
+				"principal_tenant", principal.Tenant, "tenant", tenant)
+			return false
+		}
+	}
+	return true
+}
+
+// Like principalsAllowTenant, but quiet, for filtering lists
+func tenantsAllow(r *http.Request, tenant string) bool {
+	for _, principal := range requestPrincipals(r) {
+		if principal.Tenant != "" && principal.Tenant != tenant {
+			return false
+		}
+	}
+	return true
+}
+
+// Tenant that r is scoped to, or "" if it isn't
+func requestTenant(r *http.Request) string {
+	for _, principal := range requestPrincipals(r) {
+		if principal.Tenant != "" {
+			return principal.Tenant
+		}
+	}
+	return ""
+}
+
+// Checks that r may write resolver, which is about to be saved or deleted. Saved resolvers without a tenant are
+// given the tenant of r. Returns the HTTP status code to respond with if not.
+func authorizeResolverWrite(r *http.Request, database *Database, resolver *Resolver) (error, int) {
+	// Expired resolvers still belong to their tenant until they are collected, so their ids can't be taken over.
+	// We get err if there are no resolvers yet, which is not an error.
+	_, stored := database.ReadStoredResolvers()
+	for _, existing := range stored {
+		if existing.Id == resolver.Id && !principalsAllowTenant(r, existing.Tenant) {
+			return errors.New(fmt.Sprintf("Resolver %s belongs to another tenant", resolver.Id)), http.StatusForbidden
+		}
+	}
+	if r.Method != http.MethodPut {
+		return nil, 0
+	}
+	if resolver.Tenant == "" {
+		resolver.Tenant = requestTenant(r)
+	}
+	if !principalsAllowTenant(r, resolver.Tenant) {
+		return errors.New(fmt.Sprintf("Not allowed to write resolvers of tenant %s", resolver.Tenant)), http.StatusForbidden
+	}
+	// Tenants must not be able to hijack each other's listeners
+	_, resolvers := database.ReadAllResolvers()
+	for _, existing := range resolvers {
+		if existing.Id == resolver.Id || existing.Tenant == resolver.Tenant {
+			continue
+		}
+		for _, existingListener := range existing.Listeners {
+			for _, listener := range resolver.Listeners {
+				if existingListener.Key() == listener.Key() {
+					return errors.New(fmt.Sprintf("Listener %s is used by resolver %s of another tenant",
+						listener.Key(), existing.Id)), http.StatusConflict
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+// Checks that r may write DnsMessages to resolverIds. Clients scoped to a tenant may only write to existing resolvers
+// of that tenant. Returns the HTTP status code to respond with if not.
+func authorizeDnsMessageWrite(r *http.Request, database *Database, resolverIds []string) (error, int) {
+	if requestTenant(r) == "" {
+		return nil, 0
+	}
+	// Expired resolvers still belong to their tenant until they are collected
+	_, stored := database.ReadStoredResolvers()
+	for _, resolverId := range resolverIds {
+		var resolver *Resolver
+		for _, existing := range stored {
+			if existing.Id == resolverId {
+				resolver = existing
+			}
+		}
+		if resolver == nil {
+			return errors.New(fmt.Sprintf("No such resolver %s", resolverId)), http.StatusForbidden
+		}
+		if !principalsAllowTenant(r, resolver.Tenant) {
+			return errors.New(fmt.Sprintf("Resolver %s belongs to another tenant", resolverId)), http.StatusForbidden
+		}
+	}
+	return nil, 0
+}
@@ -37,6 +37,9 @@ set_up() {
   echo Installing requirements in $GOPATH
   go get github.com/nanobox-io/golang-scribble
   go get github.com/miekg/dns
+  go get github.com/dnstap/golang-dnstap
+  go get github.com/dnstap/golang-dnstap/dnstap
+  go get google.golang.org/protobuf
   # Build YesDNS
   echo Building YesDNS
   go install github.com/alangibson/yesdns
@@ -142,6 +145,15 @@ curl -v -X PUT -d@./test/data/SOA.json localhost:5380/v1/question
 dig @localhost -p 8056 some.example.com. SOA | grep 'flags:.*aa.*;'
 assert_exit_ok $?
 
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test TXT Record
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/TXT.json localhost:5380/v1/question
+# Exactly the two strings, without empty ones in front
+test "$(dig @localhost -p 8056 +short some.example.com. TXT)" = '"Text line 1 of 2" "Text line 2 of 2"'
+assert_exit_ok $?
+
 echo //////////////////////////////////////////////////////////////////////////
 echo // Test Delete DNS Record
 echo //////////////////////////////////////////////////////////////////////////
@@ -161,6 +173,77 @@ assert_dig_ok @localhost 8056 notreal.example.com. A
 dig @localhost -p 8056 notreal.example.com. A | grep '^notreal.example.com.'
 assert_exit_ok $?
 
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Response Sequence
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-sequence.json localhost:5380/v1/question
+test "$(dig @localhost -p 8056 +short failover.example.com. A)" = "1.2.3.4"
+assert_exit_ok $?
+test "$(dig @localhost -p 8056 +short failover.example.com. A)" = "1.2.3.4"
+assert_exit_ok $?
+test "$(dig @localhost -p 8056 +short failover.example.com. A)" = "5.6.7.8"
+assert_exit_ok $?
+test "$(dig @localhost -p 8056 +short failover.example.com. A)" = "5.6.7.8"
+assert_exit_ok $?
+# Unknown selections are rejected
+test "$(jq '.selection="sequential"' ./test/data/A-sequence.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/question)" = "400"
+assert_exit_ok $?
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test RRset Order
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+jq '.answer += [.answer[0] | .rdata="5.6.7.8"] | .rrset_order="cyclic"' ./test/data/A-wildcard.json | curl -v -X PUT -d@- localhost:5380/v1/question
+# All names answered by the wildcard share one rotation
+test "$(dig @localhost -p 8056 +short a.example.com. A | head -1)" = "1.2.3.4"
+assert_exit_ok $?
+test "$(dig @localhost -p 8056 +short b.example.com. A | head -1)" = "5.6.7.8"
+assert_exit_ok $?
+# Saving the message again starts the rotation over
+jq '.answer += [.answer[0] | .rdata="5.6.7.8"] | .rrset_order="cyclic"' ./test/data/A-wildcard.json | curl -v -X PUT -d@- localhost:5380/v1/question
+test "$(dig @localhost -p 8056 +short c.example.com. A | head -1)" = "1.2.3.4"
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/A-wildcard.json localhost:5380/v1/question
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Delay
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-delay.json localhost:5380/v1/question
+assert_dig_nok @localhost 8056 +timeout=1 slow.example.com.
+assert_dig_ok @localhost 8056 +timeout=3 slow.example.com.
+# Negative delays are rejected
+test "$(jq '.delay={"fixed_ms":-1}' ./test/data/A-delay.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/question)" = "400"
+assert_exit_ok $?
+test "$(jq '.delay={"min_ms":-5,"max_ms":10}' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Fault Injection
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+fault_sequence() {
+  jq '.fault={"servfail":0.5,"seed":42}' ./test/data/A-default.json | curl -v -X PUT -d@- localhost:5380/v1/question
+  for i in 1 2 3 4 5 6 7 8; do
+    dig @localhost -p 8056 hostname.example.com. A | grep -o 'status: [A-Z]*'
+  done
+}
+FAULTS=$(fault_sequence)
+echo "$FAULTS" | grep -q SERVFAIL && echo "$FAULTS" | grep -q NOERROR
+assert_exit_ok $?
+# The same seed gives the same faults every time the message is saved
+test "$(fault_sequence)" = "$FAULTS"
+assert_exit_ok $?
+# Probabilities must be between 0.0 and 1.0 and add up to at most 1.0
+test "$(jq '.fault={"drop":1.5}' ./test/data/A-default.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/question)" = "400"
+assert_exit_ok $?
+test "$(jq '.fault={"drop":0.6,"servfail":0.6}' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+test "$(jq '.fault={"drop":-0.1}' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+
 echo //////////////////////////////////////////////////////////////////////////
 echo // Test Forwarding
 echo //////////////////////////////////////////////////////////////////////////
@@ -177,6 +260,513 @@ assert_dig_ok @localhost 8056 www.google.com. A
 jq 'del(.forwarders)' test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
 assert_dig_nok @localhost 8056 www.google.com. A
 
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Metrics
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+dig @localhost -p 8056 hostname.example.com. A
+curl -s localhost:5380/metrics | grep '^yesdns_queries_total{resolver="default",.*qtype="A",rcode="NOERROR"}'
+assert_exit_ok $?
+# Unknown query types share one time series
+dig @localhost -p 8056 hostname.example.com. TYPE65000
+curl -s localhost:5380/metrics | grep -q '^yesdns_queries_total{resolver="default",.*qtype="other",'
+assert_exit_ok $?
+curl -s localhost:5380/metrics | grep -q 'qtype="TYPE65000"'
+assert_exit_nok $?
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Expiring Resolver
+echo //////////////////////////////////////////////////////////////////////////
+jq -n '{id: "expiring", ttl_seconds: 2, patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8059"}], views: [{name: "local", client_cidrs: ["127.0.0.0/8"]}], zones: [{apex: "example.com.", dnssec: {}}]}' | curl -v -X PUT -d@- localhost:5380/v1/resolver
+jq '.resolvers=["expiring"]' ./test/data/A-default.json | curl -v -X PUT -d@- localhost:5380/v1/question
+jq '.resolvers=["expiring"] | .view="local"' ./test/data/MX.json | curl -v -X PUT -d@- localhost:5380/v1/question
+curl -v -X PUT -d '{"resolver": "expiring", "zone": "example.com."}' localhost:5380/v1/dnssec-keys
+assert_dig_ok @localhost 8059 hostname.example.com. A
+# Garbage collection deletes everything of the resolver, so a new one with the same id starts empty
+sleep 12
+jq -n '{id: "expiring", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8059"}]}' | curl -v -X PUT -d@- localhost:5380/v1/resolver
+sleep 1
+assert_dig_nok @localhost 8059 hostname.example.com. A
+assert_dig_nok @localhost 8059 example.com. MX
+test "$(curl -s 'localhost:5380/v1/dnssec-keys?resolver=expiring' | jq length)" = "0"
+assert_exit_ok $?
+curl -v -X DELETE -d '{"id": "expiring"}' localhost:5380/v1/resolver
+# A GC interval without a unit is rejected instead of disabling garbage collection
+YESDNS_GC_INTERVAL=10 $GOPATH/bin/yesdns -http-listen=localhost:5381 2>&1 | grep -q 'Invalid YESDNS_GC_INTERVAL'
+assert_exit_ok $?
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Log Level
+echo //////////////////////////////////////////////////////////////////////////
+test "$(curl -s localhost:5380/v1/log-level | jq -r .level)" = "info"
+assert_exit_ok $?
+curl -v -X PUT -d '{"level": "debug"}' localhost:5380/v1/log-level
+test "$(curl -s localhost:5380/v1/log-level | jq -r .level)" = "debug"
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+dig @localhost -p 8056 hostname.example.com. A
+grep -q '"level":"DEBUG","msg":"Received query"' yesdns.log
+assert_exit_ok $?
+test "$(curl -s -o /dev/null -w '%{http_code}' -X PUT -d '{"level": "loud"}' localhost:5380/v1/log-level)" = "400"
+assert_exit_ok $?
+curl -v -X PUT -d '{"level": "info"}' localhost:5380/v1/log-level
+# The -log-level flag sets the level at startup
+$GOPATH/bin/yesdns -http-listen=localhost:5381 -db-dir=./db-log-level -log-level=warn >> yesdns.log 2>&1 &
+LOG_LEVEL_PID=$!
+sleep 2
+test "$(curl -s localhost:5381/v1/log-level | jq -r .level)" = "warn"
+assert_exit_ok $?
+kill $LOG_LEVEL_PID
+rm -fr db-log-level
+$GOPATH/bin/yesdns -http-listen=localhost:5381 -log-level=loud 2>&1 | grep -q 'Invalid log level'
+assert_exit_ok $?
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Query Log
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+curl -v -X DELETE localhost:5380/v1/queries
+dig @localhost -p 8056 hostname.example.com. A
+dig @localhost -p 8056 +tcp hostname.example.com. A
+test "$(curl -s 'localhost:5380/v1/queries?qname=hostname.example.com.&qtype=A&answered_by=internal' | jq length)" = "2"
+assert_exit_ok $?
+test "$(curl -s 'localhost:5380/v1/queries?qname=hostname.example.com.&net=tcp' | jq length)" = "1"
+assert_exit_ok $?
+# A stored failure stays answered by it when forwarding fails too
+jq '.forwarders=[{"net":"udp","address":"127.0.0.1:9"}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+jq '.header.rcode=3 | .answer=[]' ./test/data/A-default.json | curl -v -X PUT -d@- localhost:5380/v1/question
+curl -v -X DELETE localhost:5380/v1/queries
+dig @localhost -p 8056 hostname.example.com. A | grep -q "status: NXDOMAIN"
+assert_exit_ok $?
+test "$(curl -s 'localhost:5380/v1/queries?qname=hostname.example.com.&answered_by=internal' | jq length)" = "1"
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+# A bad size is rejected instead of disabling the query log
+YESDNS_QUERY_LOG_SIZE=lots $GOPATH/bin/yesdns -http-listen=localhost:5381 2>&1 | grep -q 'Invalid YESDNS_QUERY_LOG_SIZE'
+assert_exit_ok $?
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Dnstap
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+rm -fr db-dnstap yesdns.dnstap
+$GOPATH/bin/yesdns -http-listen=localhost:5382 -db-dir=./db-dnstap -dnstap=./yesdns.dnstap >> yesdns.log 2>&1 &
+DNSTAP_PID=$!
+sleep 2
+jq -n '{id: "dnstap", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8058"}], forwarders: [{net: "udp", address: "127.0.0.1:8056"}]}' | curl -v -X PUT -d@- localhost:5382/v1/resolver
+assert_dig_ok @localhost 8058 hostname.example.com. A
+# Stopping YesDNS flushes the dnstap file
+kill $DNSTAP_PID
+sleep 1
+for type in CLIENT_QUERY FORWARDER_QUERY FORWARDER_RESPONSE CLIENT_RESPONSE; do
+  $GOPATH/bin/dnstap -r yesdns.dnstap -y | grep -q "type: $type"
+  assert_exit_ok $?
+done
+$GOPATH/bin/dnstap -r yesdns.dnstap -y | grep -q 'response_address: 127.0.0.1'
+assert_exit_ok $?
+rm -fr db-dnstap yesdns.dnstap
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Views
+echo //////////////////////////////////////////////////////////////////////////
+jq '.views=[{"name":"local","client_cidrs":["127.0.0.0/8"]}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+jq '.view="local" | .answer[0].rdata="10.0.0.1"' ./test/data/A-default.json | curl -v -X PUT -d@- localhost:5380/v1/question
+curl -v -X PUT -d@./test/data/MX.json localhost:5380/v1/question
+test "$(dig @localhost -p 8056 +short hostname.example.com. A)" = "10.0.0.1"
+assert_exit_ok $?
+# Names without a message in the view fall back to messages without a view, and count as one lookup hit
+MISSES=$(curl -s localhost:5380/metrics | grep 'yesdns_internal_lookups_total{resolver="default",match="exact",result="miss"}' | cut -d' ' -f2)
+assert_dig_ok @localhost 8056 example.com. MX
+test "$(curl -s localhost:5380/metrics | grep 'yesdns_internal_lookups_total{resolver="default",match="exact",result="miss"}' | cut -d' ' -f2)" = "$MISSES"
+assert_exit_ok $?
+# Invalid views are rejected
+test "$(jq '.views=[{"name":"local","client_cidrs":["127.0.0/8"]}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+test "$(jq '.views=[{"name":"../local","client_cidrs":["127.0.0.0/8"]}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+test "$(jq '.view="../local"' ./test/data/A-default.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/question)" = "400"
+assert_exit_ok $?
+jq '.view="local"' ./test/data/A-default.json | curl -v -X DELETE -d@- localhost:5380/v1/question
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test EDNS Client Subnet
+echo //////////////////////////////////////////////////////////////////////////
+jq '.views=[{"name":"europe","client_cidrs":[],"ecs_cidrs":["2.0.0.0/8"]}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+jq '.view="europe" | .answer[0].rdata="2.2.2.2"' ./test/data/A-default.json | curl -v -X PUT -d@- localhost:5380/v1/question
+curl -v -X PUT -d@./test/data/MX.json localhost:5380/v1/question
+dig @localhost -p 8056 +subnet=2.3.4.0/24 hostname.example.com. A | grep -q 'CLIENT-SUBNET: 2.3.4.0/24/24'
+assert_exit_ok $?
+# Answers from outside the view picked by ECS are good for any subnet
+dig @localhost -p 8056 +subnet=2.3.4.0/24 example.com. MX | grep -q 'CLIENT-SUBNET: 2.3.4.0/24/0'
+assert_exit_ok $?
+jq '.view="europe"' ./test/data/A-default.json | curl -v -X DELETE -d@- localhost:5380/v1/question
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test ACL
+echo //////////////////////////////////////////////////////////////////////////
+jq '.acl={"deny":["127.0.0.0/8"]}' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+dig @localhost -p 8056 hostname.example.com. A | grep -q "status: REFUSED"
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+assert_dig_ok @localhost 8056 hostname.example.com. A
+# Invalid entries are rejected rather than skipped
+test "$(jq '.acl={"deny":["127.0.0.0/33"]}' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+test "$(jq '.listeners[0].acl={"allow":["localhost"]}' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+assert_dig_ok @localhost 8056 hostname.example.com. A
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Response Rate Limiting
+echo //////////////////////////////////////////////////////////////////////////
+jq '.rate_limit={"responses_per_second":1,"slip":2}' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+for i in $(seq 1 10); do
+  dig @localhost -p 8056 +ignore +tries=1 +timeout=2 hostname.example.com. A > rrl.$i &
+done
+wait
+# Responses beyond the rate are either slipped (empty with TC set) or dropped
+test "$(grep -l 'flags:.* tc' rrl.* | wc -l)" -ge 1
+assert_exit_ok $?
+test "$(grep -l 'timed out' rrl.* | wc -l)" -ge 1
+assert_exit_ok $?
+test "$(grep -l 'ANSWER: 1' rrl.* | wc -l)" -lt 10
+assert_exit_ok $?
+rm -f rrl.*
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test TSIG
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d '{"name": "test-key.", "algorithm": "hmac-sha256", "secret": "c2VjcmV0LXNlY3JldC1zZWNyZXQ="}' localhost:5380/v1/tsig-keys
+jq '.tsig_keys=[{"name":"test-key."}] | .require_tsig=true' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+dig @localhost -p 8056 hostname.example.com. A | grep -q "status: REFUSED"
+assert_exit_ok $?
+dig @localhost -p 8056 -y hmac-sha256:test-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ= hostname.example.com. A | grep -q "status: NOERROR"
+assert_exit_ok $?
+curl -s localhost:5380/v1/tsig-keys | grep -q secret
+assert_exit_nok $?
+# Resolvers on the same listener can't have different keys of the same name
+test "$(jq -n '{id: "tsig-other", patterns: ["other.example."], listeners: [{net: "udp", address: "0.0.0.0:8056"}], tsig_keys: [{name: "test-key.", algorithm: "hmac-sha256", secret: "b3RoZXItc2VjcmV0"}]}' | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "409"
+assert_exit_ok $?
+curl -v -X DELETE -d '{"name": "test-key."}' localhost:5380/v1/tsig-keys
+# hmac-md5 is deprecated but still accepted
+jq '.tsig_keys=[{"name":"md5-key.","algorithm":"hmac-md5","secret":"c2VjcmV0LXNlY3JldC1zZWNyZXQ="}] | .require_tsig=true' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver | grep -q '^200$'
+assert_exit_ok $?
+dig @localhost -p 8056 -y hmac-md5:md5-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ= hostname.example.com. A | grep -q "status: NOERROR"
+assert_exit_ok $?
+grep -q 'hmac-md5 is deprecated' yesdns.log
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test EDNS0 and Truncation
+echo //////////////////////////////////////////////////////////////////////////
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-big.json localhost:5380/v1/question
+dig @localhost -p 8056 +noedns +ignore big.example.com. A | grep -q 'flags:.* tc'
+assert_exit_ok $?
+dig @localhost -p 8056 +bufsize=1232 big.example.com. A | grep -q 'udp: 1232'
+assert_exit_ok $?
+# Truncation leaves room for the TSIG RR
+jq '.tsig_keys=[{"name":"test-key.","algorithm":"hmac-sha256","secret":"c2VjcmV0LXNlY3JldC1zZWNyZXQ="}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+dig @localhost -p 8056 +bufsize=1024 +ignore -y hmac-sha256:test-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ= big.example.com. A | grep -q 'flags:.* tc'
+assert_exit_ok $?
+test "$(dig @localhost -p 8056 +bufsize=1024 +ignore -y hmac-sha256:test-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ= big.example.com. A | sed -n 's/.*MSG SIZE  rcvd: \([0-9]*\).*/\1/p')" -le 1024
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+# Unknown EDNS versions get BADVERS
+dig @localhost -p 8056 +edns=1 +noednsnegotiation big.example.com. A | grep -q 'status: BADVERS'
+assert_exit_ok $?
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Zones and DNSSEC
+echo //////////////////////////////////////////////////////////////////////////
+jq '.zones=[{"apex":"example.com.","dnssec":{}}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+curl -v -X PUT -d '{"resolver": "default", "zone": "example.com."}' localhost:5380/v1/dnssec-keys
+dig @localhost -p 8056 nope.example.com. A | grep -q "status: NXDOMAIN"
+assert_exit_ok $?
+dig @localhost -p 8056 hostname.example.com. AAAA | grep -q "status: NOERROR"
+assert_exit_ok $?
+dig @localhost -p 8056 +dnssec hostname.example.com. A | grep -q "RRSIG"
+assert_exit_ok $?
+dig @localhost -p 8056 +dnssec nope.example.com. A | grep -q "NXNAME\|TYPE128"
+assert_exit_ok $?
+curl -s localhost:5380/v1/dnssec-keys | grep -q private_key
+assert_exit_nok $?
+# Keys of resolver a and zone b-c. don't collide with keys of resolver a-b and zone c.
+curl -v -X PUT -d '{"resolver": "a", "zone": "b-c."}' localhost:5380/v1/dnssec-keys
+curl -v -X PUT -d '{"resolver": "a-b", "zone": "c."}' localhost:5380/v1/dnssec-keys
+test "$(curl -s localhost:5380/v1/dnssec-keys | jq -c '[.[] | select(.resolver == "a" or .resolver == "a-b") | [.resolver, .zone]]')" = '[["a","b-c."],["a-b","c."]]'
+assert_exit_ok $?
+curl -v -X DELETE -d '{"resolver": "a", "zone": "b-c."}' localhost:5380/v1/dnssec-keys
+curl -v -X DELETE -d '{"resolver": "a-b", "zone": "c."}' localhost:5380/v1/dnssec-keys
+# Zones and resolver ids that could escape the database directory are rejected
+test "$(curl -s -o /dev/null -w '%{http_code}' -X DELETE -d '{"resolver": "default", "zone": "/x/../../."}' localhost:5380/v1/dnssec-keys)" = "400"
+assert_exit_ok $?
+test "$(curl -s -o /dev/null -w '%{http_code}' -X DELETE -d '{"resolver": "..", "zone": "example.com."}' localhost:5380/v1/dnssec-keys)" = "400"
+assert_exit_ok $?
+test "$(jq '.zones=[{"apex":"/x/../../."}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -s -o /dev/null -w '%{http_code}' -X PUT -d@- localhost:5380/v1/resolver)" = "400"
+assert_exit_ok $?
+test -d db/v1/resolvers
+assert_exit_ok $?
+# Empty non-terminals and names matched by a wildcard exist, just not with the queried type
+jq '.question[0].qname="a.ent.example.com." | .answer[0].name="a.ent.example.com." | del(.ns, .extra)' ./test/data/A-default.json | curl -v -X PUT -d@- localhost:5380/v1/question
+jq '.question[0].qname="*.wild.example.com."' ./test/data/A-wildcard.json | curl -v -X PUT -d@- localhost:5380/v1/question
+dig @localhost -p 8056 ent.example.com. A | grep -q "status: NOERROR"
+assert_exit_ok $?
+dig @localhost -p 8056 +dnssec ent.example.com. A | grep -q '^ent.example.com..*NSEC.*\\000.ent.example.com.'
+assert_exit_ok $?
+dig @localhost -p 8056 host.wild.example.com. MX | grep -q "status: NOERROR"
+assert_exit_ok $?
+dig @localhost -p 8056 host.wild.example.com. A | grep -q "1.2.3.4"
+assert_exit_ok $?
+# The SOA of negative answers has the negative TTL, the lower of its TTL and minimum
+jq '.question[0].qname="example.com." | .answer[0].name="example.com." | .answer[0].ttl=3600 | .answer[0].rdata.minttl=60' ./test/data/SOA.json | curl -v -X PUT -d@- localhost:5380/v1/question
+test "$(dig @localhost -p 8056 +noall +authority nope.example.com. A | awk '$4 == "SOA" {print $2}')" = "60"
+assert_exit_ok $?
+jq '.question[0].qname="a.ent.example.com."' ./test/data/A-default.json | curl -v -X DELETE -d@- localhost:5380/v1/question
+jq '.question[0].qname="*.wild.example.com."' ./test/data/A-wildcard.json | curl -v -X DELETE -d@- localhost:5380/v1/question
+jq '.question[0].qname="example.com."' ./test/data/SOA.json | curl -v -X DELETE -d@- localhost:5380/v1/question
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test DNSSEC Validation
+echo //////////////////////////////////////////////////////////////////////////
+DS=$(curl -s 'localhost:5380/v1/dnssec-keys?resolver=default&zone=example.com.' | jq -r '.[0].ds')
+jq -n --arg ds "$DS" '{id: "validator", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8057"}], forwarders: [{net: "udp", address: "127.0.0.1:8056"}], dnssec_validation: {trust_anchors: [$ds]}}' | curl -v -X PUT -d@- localhost:5380/v1/resolver
+dig @localhost -p 8057 +dnssec hostname.example.com. A | grep -q 'flags:.* ad'
+assert_exit_ok $?
+jq -n '{id: "validator", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8057"}], forwarders: [{net: "udp", address: "127.0.0.1:8056"}], dnssec_validation: {trust_anchors: ["example.com. 3600 IN DS 1 13 2 0000000000000000000000000000000000000000000000000000000000000000"]}}' | curl -v -X PUT -d@- localhost:5380/v1/resolver
+dig @localhost -p 8057 +dnssec hostname.example.com. A | grep -q "status: SERVFAIL"
+assert_exit_ok $?
+curl -v -X DELETE -d '{"id": "validator"}' localhost:5380/v1/resolver
+curl -v -X DELETE -d '{"resolver": "default", "zone": "example.com."}' localhost:5380/v1/dnssec-keys
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Zone Transfer
+echo //////////////////////////////////////////////////////////////////////////
+jq '.zones=[{"apex":"example.com.","transfer":{"acl":{"allow":["127.0.0.0/8"]}}}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+test "$(dig @localhost -p 8056 example.com. AXFR | grep -c 'IN.SOA')" = "2"
+assert_exit_ok $?
+dig @localhost -p 8056 example.com. AXFR | grep -q 'hostname.example.com.'
+assert_exit_ok $?
+OLD_SERIAL=$(dig @localhost -p 8056 +short example.com. SOA | awk '{print $3}')
+curl -v -X PUT -d@./test/data/MX.json localhost:5380/v1/question
+# The apex SOA has the serial of the latest journaled change
+NEW_SERIAL=$(dig @localhost -p 8056 +short example.com. SOA | awk '{print $3}')
+test "$NEW_SERIAL" -gt "$OLD_SERIAL"
+assert_exit_ok $?
+# IXFR is the new SOA, the old SOA with the deleted records, the new SOA with the added ones, then the new SOA again
+test "$(dig @localhost -p 8056 +noall +answer example.com. IXFR=$OLD_SERIAL | awk '$4 == "SOA" {print $7}' | xargs)" = "$NEW_SERIAL $OLD_SERIAL $NEW_SERIAL $NEW_SERIAL"
+assert_exit_ok $?
+dig @localhost -p 8056 +noall +answer example.com. IXFR=$OLD_SERIAL | grep -q 'mail.example.com.'
+assert_exit_ok $?
+jq '.zones=[{"apex":"example.com."}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+dig @localhost -p 8056 example.com. AXFR | grep -q 'Transfer failed'
+assert_exit_ok $?
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Secondary Zone
+echo //////////////////////////////////////////////////////////////////////////
+jq '.zones=[{"apex":"example.com.","transfer":{"acl":{"allow":["127.0.0.0/8"]}},"notify":["127.0.0.1:8054"]}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/A-default.json localhost:5380/v1/question
+jq '.zones=[{"apex":"example.com.","primary":{"address":"127.0.0.1:8056"}}]' ./test/data/resolvers/resolver-0.0.0.0:8054.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+sleep 2
+dig @localhost -p 8054 hostname.example.com. A | grep -q '1.2.3.4'
+assert_exit_ok $?
+# Changes on the primary reach the secondary with NOTIFY
+curl -v -X PUT -d '{"level": "debug"}' localhost:5380/v1/log-level
+curl -v -X PUT -d@./test/data/SRV.json localhost:5380/v1/question
+sleep 2
+grep -q '"msg":"Received NOTIFY","resolver":"resolver-0.0.0.0:8054"' yesdns.log
+assert_exit_ok $?
+grep -q '"msg":"Secondary acknowledged NOTIFY","resolver":"default"' yesdns.log
+assert_exit_ok $?
+curl -v -X PUT -d '{"level": "info"}' localhost:5380/v1/log-level
+dig @localhost -p 8054 _http._tcp.some.example.com. SRV | grep -q 'www.some.example.com.'
+assert_exit_ok $?
+# Expired records are deleted from the secondary too once garbage collection journals their deletion
+jq '.ttl_seconds=2' ./test/data/MX.json | curl -v -X PUT -d@- localhost:5380/v1/question
+sleep 2
+dig @localhost -p 8054 example.com. MX | grep -q 'mail.example.com.'
+assert_exit_ok $?
+sleep 12
+dig @localhost -p 8054 example.com. MX | grep -q 'mail.example.com.'
+assert_exit_nok $?
+# Overrides take precedence over transferred records
+jq '.resolvers=["resolver-0.0.0.0:8054"] | .answer[0].rdata="9.9.9.9"' ./test/data/A-default.json | curl -v -X PUT -d@- localhost:5380/v1/question
+dig @localhost -p 8054 hostname.example.com. A | grep -q '9.9.9.9'
+assert_exit_ok $?
+curl -v -X DELETE -d@./test/data/resolvers/resolver-0.0.0.0:8054.json localhost:5380/v1/resolver
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Dynamic Update
+echo //////////////////////////////////////////////////////////////////////////
+jq '.tsig_keys=[{"name":"ddns-key.","secret":"c2VjcmV0LXNlY3JldC1zZWNyZXQ="}] | .zones=[{"apex":"example.com.","update":{"tsig_keys":["ddns-key."]}}]' ./test/data/resolvers/default-0.0.0.0-8056.json | curl -v -X PUT -d@- localhost:5380/v1/resolver
+printf 'server 127.0.0.1 8056\nzone example.com.\nupdate add new.example.com. 60 A 5.6.7.8\nsend\n' | nsupdate -y hmac-sha256:ddns-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ=
+assert_exit_ok $?
+dig @localhost -p 8056 new.example.com. A | grep -q '5.6.7.8'
+assert_exit_ok $?
+# Prerequisites must be met
+printf 'server 127.0.0.1 8056\nzone example.com.\nprereq nxdomain new.example.com.\nupdate add other.example.com. 60 A 5.6.7.9\nsend\n' | nsupdate -y hmac-sha256:ddns-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ=
+assert_exit_nok $?
+printf 'server 127.0.0.1 8056\nzone example.com.\nupdate delete new.example.com. A\nsend\n' | nsupdate -y hmac-sha256:ddns-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ=
+assert_exit_ok $?
+dig @localhost -p 8056 new.example.com. A | grep -q 'NXDOMAIN'
+assert_exit_ok $?
+# The zone section must be class IN
+printf 'server 127.0.0.1 8056\nclass CH\nzone example.com.\nupdate add new.example.com. 60 A 5.6.7.8\nsend\n' | nsupdate -y hmac-sha256:ddns-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ= 2>&1 | grep -q 'FORMERR'
+assert_exit_ok $?
+# Updates are applied completely or not at all
+printf 'server 127.0.0.1 8056\nzone example.com.\nupdate add good.example.com. 60 A 5.6.7.8\nupdate add good.example.com. 60 HINFO "cpu" "os"\nsend\n' | nsupdate -y hmac-sha256:ddns-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ= 2>&1 | grep -q 'REFUSED'
+assert_exit_ok $?
+dig @localhost -p 8056 good.example.com. A | grep -q 'NXDOMAIN'
+assert_exit_ok $?
+# Prerequisites are checked before the updates
+printf 'server 127.0.0.1 8056\nzone example.com.\nprereq yxdomain good.example.com.\nupdate add good.example.com. 60 HINFO "cpu" "os"\nsend\n' | nsupdate -y hmac-sha256:ddns-key.:c2VjcmV0LXNlY3JldC1zZWNyZXQ= 2>&1 | grep -q 'NXDOMAIN'
+assert_exit_ok $?
+# Unsigned updates are refused
+printf 'server 127.0.0.1 8056\nzone example.com.\nupdate add new.example.com. 60 A 5.6.7.8\nsend\n' | nsupdate
+assert_exit_nok $?
+curl -v -X PUT -d@./test/data/resolvers/default-0.0.0.0-8056.json localhost:5380/v1/resolver
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Authentication
+echo //////////////////////////////////////////////////////////////////////////
+rm -fr db-auth
+$GOPATH/bin/yesdns -http-listen=localhost:5383 -db-dir=./db-auth -api-tokens=admin-token:write,reader-token:read >> yesdns.log 2>&1 &
+AUTH_PID=$!
+sleep 2
+for endpoint in question resolver tsig-keys dnssec-keys log-level queries; do
+  # Missing token
+  test "$(curl -s -o /dev/null -w '%{http_code}' localhost:5383/v1/$endpoint)" = "401"
+  assert_exit_ok $?
+  test "$(curl -s -o /dev/null -w '%{http_code}' -X PUT -d '{}' localhost:5383/v1/$endpoint)" = "401"
+  assert_exit_ok $?
+  # Wrong token
+  test "$(curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer wrong-token' localhost:5383/v1/$endpoint)" = "401"
+  assert_exit_ok $?
+  # Read token may not write
+  test "$(curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer reader-token' -X PUT -d '{}' localhost:5383/v1/$endpoint)" = "403"
+  assert_exit_ok $?
+done
+# Valid tokens
+jq -n '{id: "auth", patterns: ["."]}' | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer admin-token' -X PUT -d@- localhost:5383/v1/resolver | grep -q '^200$'
+assert_exit_ok $?
+jq '.resolvers=["auth"]' ./test/data/A-default.json | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer admin-token' -X PUT -d@- localhost:5383/v1/question | grep -q '^200$'
+assert_exit_ok $?
+for endpoint in tsig-keys dnssec-keys log-level queries; do
+  test "$(curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer reader-token' localhost:5383/v1/$endpoint)" = "200"
+  assert_exit_ok $?
+done
+# Metrics don't need a token
+test "$(curl -s -o /dev/null -w '%{http_code}' localhost:5383/metrics)" = "200"
+assert_exit_ok $?
+kill $AUTH_PID
+rm -fr db-auth
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Client Certificates
+echo //////////////////////////////////////////////////////////////////////////
+rm -fr db-mtls mtls
+mkdir mtls
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes -keyout mtls/ca.key -out mtls/ca.crt -days 1 -subj "/CN=YesDNS Test CA"
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes -keyout mtls/server.key -out mtls/server.crt -days 1 -subj "/CN=localhost" -addext "subjectAltName=DNS:localhost"
+for client in admin team-a-ci; do
+  openssl req -new -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes -keyout mtls/$client.key -out mtls/$client.csr -subj "/CN=$client"
+  openssl x509 -req -in mtls/$client.csr -CA mtls/ca.crt -CAkey mtls/ca.key -CAcreateserial -out mtls/$client.crt -days 1
+done
+echo '[{"subject": "admin", "scope": "write"}, {"subject": "team-a-ci", "scope": "write", "resolvers": ["mtls-a"]}]' > mtls/subjects.json
+$GOPATH/bin/yesdns -http-listen=localhost:5384 -db-dir=./db-mtls -tls-cert-file=mtls/server.crt -tls-key-file=mtls/server.key -tls-client-ca-file=mtls/ca.crt -tls-client-subjects-file=mtls/subjects.json >> yesdns.log 2>&1 &
+MTLS_PID=$!
+sleep 2
+ADMIN_CURL="curl -s --cacert mtls/server.crt --cert mtls/admin.crt --key mtls/admin.key"
+TEAM_A_CURL="curl -s --cacert mtls/server.crt --cert mtls/team-a-ci.crt --key mtls/team-a-ci.key"
+jq -n '{id: "mtls-a", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8060"}]}' | $ADMIN_CURL -X PUT -d@- https://localhost:5384/v1/resolver
+jq -n '{id: "mtls-b", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8061"}]}' | $ADMIN_CURL -X PUT -d@- https://localhost:5384/v1/resolver
+sleep 1
+dig @localhost -p 8060 a.example.com. A
+dig @localhost -p 8061 b.example.com. A
+# Clients without a certificate are refused
+curl -s --cacert mtls/server.crt https://localhost:5384/v1/queries
+assert_exit_nok $?
+# Clients limited to resolvers can only write to those
+test "$(jq '.resolvers=["mtls-b"]' ./test/data/A-default.json | $TEAM_A_CURL -o /dev/null -w '%{http_code}' -X PUT -d@- https://localhost:5384/v1/question)" = "403"
+assert_exit_ok $?
+# and only see queries to those
+test "$($TEAM_A_CURL https://localhost:5384/v1/queries | jq -c '[.[].resolver]')" = '["mtls-a"]'
+assert_exit_ok $?
+test "$($ADMIN_CURL https://localhost:5384/v1/queries | jq -c '[.[].resolver]')" = '["mtls-a","mtls-b"]'
+assert_exit_ok $?
+# and may not clear the query log of all resolvers
+test "$($TEAM_A_CURL -o /dev/null -w '%{http_code}' -X DELETE https://localhost:5384/v1/queries)" = "403"
+assert_exit_ok $?
+test "$($ADMIN_CURL -o /dev/null -w '%{http_code}' -X DELETE https://localhost:5384/v1/queries)" = "204"
+assert_exit_ok $?
+kill $MTLS_PID
+rm -fr db-mtls mtls
+
+echo //////////////////////////////////////////////////////////////////////////
+echo // Test Tenants
+echo //////////////////////////////////////////////////////////////////////////
+rm -fr db-tenants
+$GOPATH/bin/yesdns -http-listen=localhost:5385 -db-dir=./db-tenants -api-tokens=admin-token:write,team-a-token:write:team-a,team-b-token:write:team-b >> yesdns.log 2>&1 &
+TENANTS_PID=$!
+sleep 2
+jq -n '{id: "team-a", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8062"}]}' | curl -v -H 'Authorization: Bearer team-a-token' -X PUT -d@- localhost:5385/v1/resolver
+jq -n '{id: "team-b", patterns: ["."], listeners: [{net: "udp", address: "0.0.0.0:8063"}]}' | curl -v -H 'Authorization: Bearer team-b-token' -X PUT -d@- localhost:5385/v1/resolver
+# Cross-tenant writes are refused
+test "$(jq -n '{id: "team-a", patterns: ["."]}' | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer team-b-token' -X PUT -d@- localhost:5385/v1/resolver)" = "403"
+assert_exit_ok $?
+test "$(jq '.resolvers=["team-a"]' ./test/data/A-default.json | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer team-b-token' -X PUT -d@- localhost:5385/v1/question)" = "403"
+assert_exit_ok $?
+# Resolver ids must not contain what separates storage ids
+for id in 'team-a@view' 'team-a#example.com.' 'team-a/..' '..'; do
+  test "$(jq -n --arg id "$id" '{id: $id, patterns: ["."]}' | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer admin-token' -X PUT -d@- localhost:5385/v1/resolver)" = "400"
+  assert_exit_ok $?
+  test "$(jq --arg id "$id" '.resolvers=[$id]' ./test/data/A-default.json | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer admin-token' -X PUT -d@- localhost:5385/v1/question)" = "400"
+  assert_exit_ok $?
+done
+# Tenants only see queries to their own resolvers
+sleep 1
+dig @localhost -p 8062 a.example.com. A
+dig @localhost -p 8063 b.example.com. A
+test "$(curl -s -H 'Authorization: Bearer team-a-token' localhost:5385/v1/queries | jq -c '[.[].resolver]')" = '["team-a"]'
+assert_exit_ok $?
+test "$(curl -s -H 'Authorization: Bearer admin-token' localhost:5385/v1/queries | jq -c '[.[].resolver]')" = '["team-a","team-b"]'
+assert_exit_ok $?
+# Only admins may change what all resolvers share
+test "$(curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer team-a-token' -X DELETE localhost:5385/v1/queries)" = "403"
+assert_exit_ok $?
+test "$(curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer team-a-token' -X PUT -d '{"level": "debug"}' localhost:5385/v1/log-level)" = "403"
+assert_exit_ok $?
+test "$(curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer admin-token' -X DELETE localhost:5385/v1/queries)" = "204"
+assert_exit_ok $?
+# Expired resolvers can't be taken over by another tenant before they are collected
+jq -n '{id: "team-a-expiring", ttl_seconds: 1, patterns: ["."]}' | curl -v -H 'Authorization: Bearer team-a-token' -X PUT -d@- localhost:5385/v1/resolver
+sleep 2
+test "$(jq -n '{id: "team-a-expiring", patterns: ["."]}' | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer team-b-token' -X PUT -d@- localhost:5385/v1/resolver)" = "403"
+assert_exit_ok $?
+test "$(jq '.resolvers=["team-a-expiring"]' ./test/data/A-default.json | curl -s -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer team-b-token' -X PUT -d@- localhost:5385/v1/question)" = "403"
+assert_exit_ok $?
+kill $TENANTS_PID
+rm -fr db-tenants
+
 echo //////////////////////////////////////////////////////////////////////////
 echo // Test TLS
 echo //////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,192 @@
+package yesdns
+
+// Zone transfers out to secondary servers (AXFR, RFC 5936, and IXFR, RFC 1995).
+// A full transfer holds the Answer sections of all DnsMessages for names in the zone, between two copies of the zone's
+// SOA. Incremental transfers are served from the zone's journal (see journal.go).
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// Number of RRs per message of a zone transfer
+const transferChunkSize = 100
+
+// Who may transfer a zone. Transfers are refused if Zone.Transfer is not set.
+type ZoneTransfer struct {
+	// Clients that may transfer the zone. An empty ACL allows everyone.
+	Acl *Acl `json:"acl,omitempty"`
+	// Names of TSIG keys that may transfer the zone. The resolver or listener must accept the keys as well.
+	TsigKeys []string `json:"tsig_keys,omitempty"`
+}
+
+// True if a client may transfer the zone, either because the ACL lets it in or because it signed the request with
+// one of our keys. tsigKey is the key the request was signed with, or nil.
+func (t *ZoneTransfer) allows(clientIp net.IP, tsigKey *TsigKey) bool {
+	if t == nil {
+		return false
+	}
+	if tsigKey != nil {
+		for _, name := range t.TsigKeys {
+			if dns.CanonicalName(name) == tsigKey.canonicalName() {
+				return true
+			}
+		}
+	}
+	return t.Acl != nil && !t.Acl.Denies(clientIp)
+}
+
+// Returns the RRs of zone except its SOA, sorted by name and type. Leaves out names that belong to nested zones.
+// In secondary zones, DnsMessages of the resolver replace transferred ones for the same name and type.
+func (r Resolver) zoneRecords(zone Zone) []dns.RR {
+	return r.storedZoneRecords(zone, false)
+}
+
+// Like zoneRecords, but includes expired DnsMessages that have not been deleted yet if withExpired is set
+func (r Resolver) storedZoneRecords(zone Zone, withExpired bool) []dns.RR {
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	overridden := make(map[string]bool)
+	for _, storageId := range r.zoneStorageIds(zone) {
+		for _, qtype := range r.Database.storedQtypes(storageId) {
+			for _, qname := range r.Database.storedQnames(storageId, qtype) {
+				if !zone.Contains(qname) {
+					continue
+				}
+				rrsetKey := fmt.Sprintf("%s/%d", qname, qtype)
+				if overridden[rrsetKey] {
+					continue
+				}
+				err, dnsMessage := r.Database.ReadResolverDnsMessage(storageId, qtype, qname)
+				if err != nil || dnsMessage.Expired() && !withExpired {
+					continue
+				}
+				overridden[rrsetKey] = true
+				answer := dnsMessage.Answer
+				if len(answer) == 0 && len(dnsMessage.Responses) > 0 {
+					answer = dnsMessage.Responses[0].Answer
+				}
+				var messageRrs []dns.RR
+				for _, rrSection := range answer {
+					rrSection.Name = ensureName(rrSection.Name, qname)
+					if err := appendRR(&messageRrs, &rrSection); err != nil {
+						logger.Warn("Cant build zone transfer RR", "zone", zone.Apex, "type", rrSection.Type, "error", err)
+					}
+				}
+				for _, rr := range messageRrs {
+					header := rr.Header()
+					if header.Rrtype == dns.TypeSOA {
+						continue
+					}
+					owner := r.zoneForQuestion(dns.Question{Name: header.Name, Qtype: header.Rrtype, Qclass: header.Class})
+					if owner == nil || owner.canonicalApex() != zone.canonicalApex() {
+						continue
+					}
+					if key := rr.String(); !seen[key] {
+						seen[key] = true
+						rrs = append(rrs, rr)
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(rrs, func(i, j int) bool {
+		if c := canonicalCompare(rrs[i].Header().Name, rrs[j].Header().Name); c != 0 {
+			return c < 0
+		}
+		return rrs[i].Header().Rrtype < rrs[j].Header().Rrtype
+	})
+	return rrs
+}
+
+// Answers an AXFR or IXFR query for the apex of one of the resolver's zones, only to clients that Zone.Transfer
+// allows. AXFR is only served over TCP. IXFR over UDP only returns the current SOA, so clients that are behind retry
+// over TCP. IXFR falls back to a full transfer if the journal doesn't go back to the client's serial.
+// tsigKey is the key the request was signed with, or nil.
+func (r Resolver) transferOut(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, listener ResolverListener,
+	tsigKey *TsigKey, clientIp net.IP) {
+	question := requestDnsMsg.Question[0]
+	refuse := func(rcode int) {
+		responseDnsMsg := new(dns.Msg)
+		responseDnsMsg.SetRcode(requestDnsMsg, rcode)
+		if tsigKey != nil {
+			signResponse(responseDnsMsg, tsigKey)
+		}
+		writeResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, &r, listener, AnsweredByNone, "")
+	}
+	overTcp := dnsResponseWriter.LocalAddr().Network() == "tcp"
+	if question.Qtype == dns.TypeAXFR && !overTcp {
+		logger.Debug("Refusing zone transfer over UDP", "resolver", r.Id, "zone", question.Name)
+		refuse(dns.RcodeRefused)
+		return
+	}
+	zone := r.zoneFor(question.Name)
+	if zone == nil || zone.canonicalApex() != dns.CanonicalName(question.Name) {
+		logger.Debug("Refusing zone transfer of unknown zone", "resolver", r.Id, "zone", question.Name)
+		refuse(dns.RcodeNotAuth)
+		return
+	}
+	if !zone.Transfer.allows(clientIp, tsigKey) {
+		logger.Info("Refusing zone transfer", "resolver", r.Id, "zone", zone.Apex, "client", clientIp.String())
+		refuse(dns.RcodeRefused)
+		return
+	}
+	if !r.zoneServable(*zone) {
+		logger.Debug("Refusing transfer of secondary zone that is not transferred yet or expired", "resolver", r.Id,
+			"zone", zone.Apex)
+		refuse(dns.RcodeServerFailure)
+		return
+	}
+
+	soa := r.zoneSoa(*zone)
+	var rrs []dns.RR
+	if question.Qtype == dns.TypeIXFR {
+		if !overTcp {
+			rrs = []dns.RR{soa}
+		} else if clientSoa := requestSoa(requestDnsMsg); clientSoa != nil {
+			rrs = r.incrementalTransfer(*zone, soa, clientSoa.Serial)
+		}
+	}
+	if rrs == nil {
+		rrs = append(append([]dns.RR{soa}, r.zoneRecords(*zone)...), soa)
+	}
+	logger.Info("Transferring zone", "resolver", r.Id, "zone", zone.Apex, "type", dns.TypeToString[question.Qtype],
+		"client", clientIp.String(), "rrs", len(rrs))
+	envelopes := make(chan *dns.Envelope)
+	go func() {
+		defer close(envelopes)
+		for start := 0; start < len(rrs); start += transferChunkSize {
+			end := start + transferChunkSize
+			if end > len(rrs) {
+				end = len(rrs)
+			}
+			envelopes <- &dns.Envelope{RR: rrs[start:end]}
+		}
+	}()
+	transfer := new(dns.Transfer)
+	if err := transfer.Out(dnsResponseWriter, requestDnsMsg, envelopes); err != nil {
+		logger.Warn("Zone transfer failed", "resolver", r.Id, "zone", zone.Apex, "error", err)
+		// Let the sender finish
+		for range envelopes {
+		}
+	}
+
+	// Record the transfer like a query that was answered with the SOA
+	responseDnsMsg := new(dns.Msg)
+	responseDnsMsg.SetReply(requestDnsMsg)
+	responseDnsMsg.Answer = []dns.RR{soa}
+	recordResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, &r, listener, AnsweredByZone, "")
+}
+
+// Returns the SOA that an IXFR request carries in its authority section, or nil
+func requestSoa(requestDnsMsg *dns.Msg) *dns.SOA {
+	for _, rr := range requestDnsMsg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
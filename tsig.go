@@ -0,0 +1,278 @@
+package yesdns
+
+// Transaction signatures (RFC 8945).
+// Keys are configured on resolvers and listeners. A listener accepts the keys of every resolver it serves,
+// but each resolver only answers queries signed with its own keys or its listener's keys.
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Algorithm used if TsigKey.Algorithm is not set
+const DefaultTsigAlgorithm = dns.HmacSHA256
+
+// Fudge (allowed clock skew) in seconds of the responses we sign
+const tsigFudge = 300
+
+// A key with only a Name refers to a managed key, see tsigkeys.go.
+type TsigKey struct {
+	Name string `json:"name"`
+	// One of hmac-md5 (deprecated), hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512
+	Algorithm string `json:"algorithm,omitempty"`
+	// Base64
+	Secret string `json:"secret,omitempty"`
+}
+
+func (k TsigKey) canonicalName() string {
+	return dns.CanonicalName(k.Name)
+}
+
+func (k TsigKey) canonicalAlgorithm() string {
+	if k.Algorithm == "" {
+		return DefaultTsigAlgorithm
+	}
+	// hmac-md5 has a longer name than the others (RFC 8945 section 6)
+	if dns.CanonicalName(k.Algorithm) == "hmac-md5." {
+		return dns.HmacMD5
+	}
+	return dns.CanonicalName(k.Algorithm)
+}
+
+func findTsigKey(keys []TsigKey, name string) *TsigKey {
+	name = dns.CanonicalName(name)
+	for i := range keys {
+		if keys[i].canonicalName() == name {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// Returns the configuration of listener in r, or listener itself if r doesn't have it (anymore).
+// Handlers hold on to the listener they were registered for, which may be stale.
+func (r Resolver) currentListener(listener ResolverListener) ResolverListener {
+	for _, configuredListener := range r.Listeners {
+		if configuredListener.Key() == listener.Key() {
+			return configuredListener
+		}
+	}
+	return listener
+}
+
+// Keys that r accepts on listener, with references to managed keys resolved.
+// References to managed keys that don't exist are left out.
+func (r Resolver) tsigKeys(listener ResolverListener) []TsigKey {
+	var keys []TsigKey
+	for _, key := range append(append([]TsigKey{}, r.currentListener(listener).TsigKeys...), r.TsigKeys...) {
+		if resolved := resolveTsigKey(key); resolved != nil {
+			keys = append(keys, *resolved)
+		}
+	}
+	return keys
+}
+
+// True if r refuses unsigned queries on listener
+func (r Resolver) requiresTsig(listener ResolverListener) bool {
+	return r.RequireTsig || r.currentListener(listener).RequireTsig
+}
+
+// Finds keys for a running dns.Server. Looks at the current configuration on every query, so keys can change
+// without restarting the server.
+type tsigKeyProvider struct {
+	listenerKey string
+}
+
+// Returns nil if resolvers on the listener have different keys named name, because we couldn't tell which one
+// to use. validateTsigKeyNames keeps that from happening, except when a managed key changes.
+func (p tsigKeyProvider) key(name string) *TsigKey {
+	currentResolvers.RLock()
+	defer currentResolvers.RUnlock()
+	var found *TsigKey
+	for _, resolver := range currentResolvers.byId {
+		for _, listener := range resolver.Listeners {
+			if listener.Key() != p.listenerKey {
+				continue
+			}
+			if key := findTsigKey(resolver.tsigKeys(listener), name); key != nil {
+				if found != nil && !found.sameAs(*key) {
+					logger.Warn("Different TSIG keys with the same name on listener", "key", name,
+						"listener", p.listenerKey)
+					return nil
+				}
+				found = key
+			}
+		}
+	}
+	return found
+}
+
+// Hash functions of the TSIG algorithms we support
+var tsigHashes = map[string]func() hash.Hash{
+	dns.HmacMD5:    md5.New,
+	dns.HmacSHA1:   sha1.New,
+	dns.HmacSHA224: sha256.New224,
+	dns.HmacSHA256: sha256.New,
+	dns.HmacSHA384: sha512.New384,
+	dns.HmacSHA512: sha512.New,
+}
+
+// Implements dns.TsigProvider
+func (p tsigKeyProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key := p.key(t.Hdr.Name)
+	if key == nil {
+		return nil, dns.ErrSecret
+	}
+	// Only accept the algorithm the key was configured with
+	if key.canonicalAlgorithm() != dns.CanonicalName(t.Algorithm) {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+	newHash, ok := tsigHashes[key.canonicalAlgorithm()]
+	if !ok {
+		return nil, dns.ErrKeyAlg
+	}
+	h := hmac.New(newHash, secret)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Implements dns.TsigProvider
+func (p tsigKeyProvider) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// Checks the TSIG of a query against the keys resolver accepts on listener.
+// Returns the key the query was signed with, or nil if it wasn't signed.
+// Returns rcode other than RcodeSuccess if the query must not be answered.
+func checkTsig(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, resolver *Resolver,
+	listener ResolverListener) (*TsigKey, int) {
+	tsig := requestDnsMsg.IsTsig()
+	if tsig == nil {
+		if resolver.requiresTsig(listener) {
+			return nil, dns.RcodeRefused
+		}
+		return nil, dns.RcodeSuccess
+	}
+	if err := dnsResponseWriter.TsigStatus(); err != nil {
+		logger.Debug("TSIG verification failed", "key", tsig.Hdr.Name, "error", err)
+		return nil, dns.RcodeNotAuth
+	}
+	// The listener accepted the key, but it may belong to another resolver on the same listener
+	key := findTsigKey(resolver.tsigKeys(listener), tsig.Hdr.Name)
+	if key == nil {
+		logger.Debug("TSIG key not accepted by resolver", "key", tsig.Hdr.Name, "resolver", resolver.Id)
+		return nil, dns.RcodeNotAuth
+	}
+	return key, dns.RcodeSuccess
+}
+
+// Signs responseDnsMsg with key, using the key's algorithm
+func signResponse(responseDnsMsg *dns.Msg, key *TsigKey) {
+	responseDnsMsg.SetTsig(key.canonicalName(), key.canonicalAlgorithm(), tsigFudge, time.Now().Unix())
+}
+
+// Size in wire format of the TSIG RR that signing a message with k adds
+func (k TsigKey) rrSize() int {
+	var macSize int
+	if newHash, ok := tsigHashes[k.canonicalAlgorithm()]; ok {
+		macSize = newHash().Size()
+	}
+	return dns.Len(&dns.TSIG{
+		Hdr:       dns.RR_Header{Name: k.canonicalName(), Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm: k.canonicalAlgorithm(),
+		MACSize:   uint16(macSize),
+		MAC:       hex.EncodeToString(make([]byte, macSize)),
+	})
+}
+
+func (k TsigKey) validate() error {
+	if k.Name == "" {
+		return errors.New("TSIG key has no name")
+	}
+	if _, ok := tsigHashes[k.canonicalAlgorithm()]; !ok {
+		return errors.New(fmt.Sprintf("Unsupported algorithm %s for TSIG key %s", k.Algorithm, k.Name))
+	}
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || k.Secret == "" {
+		return errors.New(fmt.Sprintf("Secret of TSIG key %s is not base64", k.Name))
+	}
+	if k.canonicalAlgorithm() == dns.HmacMD5 {
+		logger.Warn("TSIG algorithm hmac-md5 is deprecated, use hmac-sha256", "key", k.Name)
+	}
+	return nil
+}
+
+// True if k and other have the same name, algorithm and secret
+func (k TsigKey) sameAs(other TsigKey) bool {
+	return k.canonicalName() == other.canonicalName() && k.canonicalAlgorithm() == other.canonicalAlgorithm() &&
+		k.Secret == other.Secret
+}
+
+// Checks all TSIG keys of the resolver and its listeners. References to managed keys only need a name.
+func (r Resolver) validateTsigKeys() error {
+	keys := r.TsigKeys
+	for _, listener := range r.Listeners {
+		keys = append(append([]TsigKey{}, keys...), listener.TsigKeys...)
+	}
+	for _, key := range keys {
+		if key.Secret == "" && key.Algorithm == "" && key.Name != "" {
+			continue
+		}
+		if err := key.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that r doesn't bring a key to one of its listeners that has the same name as a different key accepted there,
+// by r itself or by another of resolvers using the listener. The listener couldn't tell which one signed a query.
+func (r Resolver) validateTsigKeyNames(resolvers []*Resolver) error {
+	for _, listener := range r.Listeners {
+		keys := r.tsigKeys(listener)
+		for _, other := range resolvers {
+			if other.Id == r.Id {
+				continue
+			}
+			for _, otherListener := range other.Listeners {
+				if otherListener.Key() == listener.Key() {
+					keys = append(keys, other.tsigKeys(otherListener)...)
+				}
+			}
+		}
+		for i := range keys {
+			for j := i + 1; j < len(keys); j++ {
+				if keys[i].canonicalName() == keys[j].canonicalName() && !keys[i].sameAs(keys[j]) {
+					return errors.New(fmt.Sprintf("TSIG key %s on listener %s differs from another key of the same name",
+						keys[i].Name, listener.Key()))
+				}
+			}
+		}
+	}
+	return nil
+}
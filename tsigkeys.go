@@ -0,0 +1,155 @@
+package yesdns
+
+// TSIG keys managed via /v1/tsig-keys and stored in the Database.
+// Resolvers and listeners use a managed key by listing it in tsig_keys with just its name.
+// Running servers pick up changed keys on the next query, so keys can be rotated without a restart.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const tsigKeysCollection = "tsig-keys"
+
+// What GET /v1/tsig-keys returns. Never includes the secret.
+type TsigKeyInfo struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+}
+
+// Managed keys indexed by canonical name
+var managedTsigKeys = struct {
+	sync.RWMutex
+	byName map[string]TsigKey
+}{byName: make(map[string]TsigKey)}
+
+func setManagedTsigKeys(keys []TsigKey) {
+	byName := make(map[string]TsigKey)
+	for _, key := range keys {
+		byName[key.canonicalName()] = key
+	}
+	managedTsigKeys.Lock()
+	managedTsigKeys.byName = byName
+	managedTsigKeys.Unlock()
+}
+
+// Returns key if it has a secret, otherwise the managed key of the same name, or nil if there is none.
+func resolveTsigKey(key TsigKey) *TsigKey {
+	if key.Secret != "" {
+		return &key
+	}
+	managedTsigKeys.RLock()
+	defer managedTsigKeys.RUnlock()
+	if managed, ok := managedTsigKeys.byName[key.canonicalName()]; ok {
+		return &managed
+	}
+	return nil
+}
+
+func (d Database) WriteTsigKey(key TsigKey) error {
+	return d.db.Write(tsigKeysCollection, key.canonicalName(), key)
+}
+
+func (d Database) DeleteTsigKey(key TsigKey) error {
+	return d.db.Delete(tsigKeysCollection, key.canonicalName())
+}
+
+func (d Database) ReadAllTsigKeys() (error, []TsigKey) {
+	jsonStrings, err := d.db.ReadAll(tsigKeysCollection)
+	if err != nil {
+		return err, nil
+	}
+	var keys []TsigKey
+	for _, jsonString := range jsonStrings {
+		var key TsigKey
+		if err := json.NewDecoder(bytes.NewBufferString(jsonString)).Decode(&key); err != nil {
+			logger.Warn("Could not decode TSIG key", "error", err)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return nil, keys
+}
+
+// Loads managed keys from the database into running servers
+func (d Database) loadTsigKeys() {
+	// We get err if there are no keys yet, which is not an error
+	_, keys := d.ReadAllTsigKeys()
+	setManagedTsigKeys(keys)
+}
+
+// True if r is not limited to some resolvers or a tenant. Only such clients may manage shared things like TSIG keys,
+// the query log and the log level.
+func unrestrictedRequest(r *http.Request) bool {
+	for _, principal := range requestPrincipals(r) {
+		if principal.Tenant != "" || len(principal.Resolvers) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Handles /v1/tsig-keys
+//
+// GET lists the names and algorithms of all managed keys.
+// PUT creates or replaces the key in the body.
+// DELETE deletes the key named in the body.
+func serveTsigKeys(database *Database, reloadChannel chan<- bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// We get err if there are no keys yet, which is not an error
+			_, keys := database.ReadAllTsigKeys()
+			infos := []TsigKeyInfo{}
+			for _, key := range keys {
+				infos = append(infos, TsigKeyInfo{Name: key.canonicalName(), Algorithm: key.canonicalAlgorithm()})
+			}
+			sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(infos)
+			return
+		}
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			http.Error(w, fmt.Sprintf("Method %s not allowed for /v1/tsig-keys\n", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if !unrestrictedRequest(r) {
+			http.Error(w, "Not allowed to manage TSIG keys\n", http.StatusForbidden)
+			return
+		}
+		if r.Body == nil {
+			http.Error(w, "Empty body not allowed", http.StatusBadRequest)
+			return
+		}
+		var key TsigKey
+		if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+			logger.Warn("Could not decode TSIG key", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut {
+			if err := key.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := database.WriteTsigKey(key); err != nil {
+				logger.Error("Error writing TSIG key", "key", key.Name, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logger.Info("Saved TSIG key", "key", key.canonicalName(), "algorithm", key.canonicalAlgorithm())
+		} else {
+			if err := database.DeleteTsigKey(key); err != nil {
+				logger.Warn("Error deleting TSIG key", "key", key.Name, "error", err)
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			logger.Info("Deleted TSIG key", "key", key.canonicalName())
+		}
+		reloadChannel <- true
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,408 @@
+package yesdns
+
+// Dynamic updates (RFC 2136) of zones, so that tools like nsupdate, certbot and external-dns can manage records.
+// Updates change the DnsMessages of the resolver like /v1/question does: each RRset is the answer section of the
+// DnsMessage for its name and type. Changes are journaled (see journal.go).
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Who may update a zone. Updates are refused if Zone.Update is not set.
+type ZoneUpdate struct {
+	// Names of TSIG keys that may update the zone. The resolver or listener must accept the keys as well.
+	TsigKeys []string `json:"tsig_keys"`
+}
+
+// True if an update signed with tsigKey may change the zone. tsigKey is nil if the update was not signed.
+func (u *ZoneUpdate) allows(tsigKey *TsigKey) bool {
+	if u == nil || tsigKey == nil {
+		return false
+	}
+	for _, name := range u.TsigKeys {
+		if dns.CanonicalName(name) == tsigKey.canonicalName() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned from the write of a journaled update to make it fail with rcode, without changing anything
+type updateError struct {
+	rcode int
+}
+
+func (e updateError) Error() string {
+	return "Update failed with " + dns.RcodeToString[e.rcode]
+}
+
+// Answers an UPDATE of one of the resolver's zones, only if it is signed with a key that Zone.Update allows.
+// Checks the prerequisites, then applies the updates in order. Nothing is changed unless all prerequisites are met and
+// all updates can be applied. tsigKey is the key the request was signed with, or nil.
+func (r Resolver) updateIn(dnsResponseWriter dns.ResponseWriter, requestDnsMsg *dns.Msg, listener ResolverListener,
+	tsigKey *TsigKey, clientIp net.IP) {
+	rcode := r.update(requestDnsMsg, tsigKey, clientIp)
+	responseDnsMsg := new(dns.Msg)
+	responseDnsMsg.SetRcode(requestDnsMsg, rcode)
+	if tsigKey != nil {
+		signResponse(responseDnsMsg, tsigKey)
+	}
+	answeredBy := AnsweredByNone
+	if rcode == dns.RcodeSuccess {
+		answeredBy = AnsweredByZone
+	}
+	writeResponse(dnsResponseWriter, requestDnsMsg, responseDnsMsg, &r, listener, answeredBy, "")
+}
+
+// Applies an UPDATE and returns the rcode to answer with
+func (r Resolver) update(requestDnsMsg *dns.Msg, tsigKey *TsigKey, clientIp net.IP) int {
+	// The zone section
+	if len(requestDnsMsg.Question) != 1 || requestDnsMsg.Question[0].Qtype != dns.TypeSOA ||
+		requestDnsMsg.Question[0].Qclass != dns.ClassINET {
+		return dns.RcodeFormatError
+	}
+	question := requestDnsMsg.Question[0]
+	zone := r.zoneFor(question.Name)
+	if zone == nil || zone.canonicalApex() != dns.CanonicalName(question.Name) {
+		logger.Debug("Refusing update of unknown zone", "resolver", r.Id, "zone", question.Name)
+		return dns.RcodeNotAuth
+	}
+	if zone.Primary != nil {
+		// Deleting a transferred record would only uncover it again
+		logger.Debug("Refusing update of secondary zone", "resolver", r.Id, "zone", zone.Apex)
+		return dns.RcodeNotAuth
+	}
+	if !zone.Update.allows(tsigKey) {
+		logger.Info("Refusing update", "resolver", r.Id, "zone", zone.Apex, "client", clientIp.String())
+		return dns.RcodeRefused
+	}
+
+	// Prerequisites are checked under the journal lock, so nothing can change in between
+	err := r.Database.journaled([]string{r.Id}, []string{zone.Apex}, func() error {
+		if rcode := r.checkPrerequisites(*zone, requestDnsMsg.Answer); rcode != dns.RcodeSuccess {
+			return updateError{rcode: rcode}
+		}
+		if rcode := zone.prescanUpdates(requestDnsMsg.Ns); rcode != dns.RcodeSuccess {
+			return updateError{rcode: rcode}
+		}
+		pending := r.pendingUpdate(*zone)
+		for _, rr := range requestDnsMsg.Ns {
+			pending.apply(rr)
+		}
+		return pending.write()
+	})
+	var failed updateError
+	if errors.As(err, &failed) {
+		logger.Debug("Update failed", "resolver", r.Id, "zone", zone.Apex, "rcode", dns.RcodeToString[failed.rcode])
+		return failed.rcode
+	}
+	if err != nil {
+		logger.Error("Could not apply update", "resolver", r.Id, "zone", zone.Apex, "error", err)
+		return dns.RcodeServerFailure
+	}
+	logger.Info("Applied update", "resolver", r.Id, "zone", zone.Apex, "updates", len(requestDnsMsg.Ns))
+	return dns.RcodeSuccess
+}
+
+// Checks the form of the update section before anything is changed (RFC 2136 section 3.4.1)
+func (z Zone) prescanUpdates(updates []dns.RR) int {
+	for _, rr := range updates {
+		header := rr.Header()
+		if !z.Contains(header.Name) {
+			return dns.RcodeNotZone
+		}
+		switch header.Class {
+		case dns.ClassINET:
+			switch header.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+			if err, _ := dnsRRFromRR(rr); err != nil {
+				logger.Debug("Refusing update with unsupported type", "type", dns.TypeToString[header.Rrtype])
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 || header.Rdlength == 0 || header.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Checks the form of the prerequisite section and the prerequisites against the records of zone (RFC 2136 section 3.2)
+func (r Resolver) checkPrerequisites(zone Zone, prerequisites []dns.RR) int {
+	// RRs of value dependent prerequisites, by RRset
+	var rrsetKeys []string
+	expected := make(map[string][]dns.RR)
+	for _, rr := range prerequisites {
+		header := rr.Header()
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !zone.Contains(header.Name) {
+			return dns.RcodeNotZone
+		}
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY {
+				if !r.nameInUse(zone, header.Name) {
+					return dns.RcodeNameError
+				}
+			} else if len(r.storedRrset(zone, header.Name, header.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY {
+				if r.nameInUse(zone, header.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if len(r.storedRrset(zone, header.Name, header.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			rrsetKey := dns.CanonicalName(header.Name) + "/" + dns.TypeToString[header.Rrtype]
+			if _, ok := expected[rrsetKey]; !ok {
+				rrsetKeys = append(rrsetKeys, rrsetKey)
+			}
+			expected[rrsetKey] = append(expected[rrsetKey], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for _, rrsetKey := range rrsetKeys {
+		header := expected[rrsetKey][0].Header()
+		if !sameRrset(expected[rrsetKey], r.storedRrset(zone, header.Name, header.Rrtype)) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// True if a and b hold the same RRs, ignoring TTLs
+func sameRrset(a []dns.RR, b []dns.RR) bool {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, candidate := range rrs {
+			if dns.IsDuplicate(candidate, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// True if name has any records. The apex always has a SOA.
+func (r Resolver) nameInUse(zone Zone, name string) bool {
+	return dns.CanonicalName(name) == zone.canonicalApex() || len(r.Database.qtypesAt(r.Id, name)) > 0
+}
+
+// Returns the RRset of name and qtype, from the answer section of its DnsMessage
+func (r Resolver) storedRrset(zone Zone, name string, qtype uint16) []dns.RR {
+	if qtype == dns.TypeSOA && dns.CanonicalName(name) == zone.canonicalApex() {
+		return []dns.RR{r.zoneSoa(zone)}
+	}
+	err, dnsMessage := r.Database.ReadResolverDnsMessage(r.Id, qtype, name)
+	if err != nil || dnsMessage.Expired() {
+		return nil
+	}
+	var rrs []dns.RR
+	for _, rrSection := range dnsMessage.Answer {
+		rrSection.Name = ensureName(rrSection.Name, name)
+		if err := appendRR(&rrs, &rrSection); err != nil {
+			logger.Warn("Cant build RR to update", "name", name, "type", rrSection.Type, "error", err)
+		}
+	}
+	return rrs
+}
+
+// An RRset by its owner name and type
+type rrsetKey struct {
+	name  string
+	qtype uint16
+}
+
+// The RRsets of a zone as an update changes them. Changes are kept in memory until all updates are applied, so that
+// an update is written completely or not at all.
+type zoneUpdate struct {
+	resolver Resolver
+	zone     Zone
+	// Changed RRsets, empty if deleted
+	rrsets map[rrsetKey][]dns.RR
+	// Keys of rrsets in the order they were first changed
+	changed []rrsetKey
+}
+
+func (r Resolver) pendingUpdate(zone Zone) *zoneUpdate {
+	return &zoneUpdate{resolver: r, zone: zone, rrsets: make(map[rrsetKey][]dns.RR)}
+}
+
+// Returns the RRset of name and qtype with the changes so far
+func (u *zoneUpdate) rrset(name string, qtype uint16) []dns.RR {
+	if rrset, ok := u.rrsets[rrsetKey{name: dns.CanonicalName(name), qtype: qtype}]; ok {
+		return append([]dns.RR(nil), rrset...)
+	}
+	return u.resolver.storedRrset(u.zone, name, qtype)
+}
+
+func (u *zoneUpdate) setRrset(name string, qtype uint16, rrset []dns.RR) {
+	key := rrsetKey{name: dns.CanonicalName(name), qtype: qtype}
+	if _, ok := u.rrsets[key]; !ok {
+		u.changed = append(u.changed, key)
+	}
+	u.rrsets[key] = rrset
+}
+
+// Returns the types of the RRsets at name with the changes so far
+func (u *zoneUpdate) qtypesAt(name string) []uint16 {
+	var qtypes []uint16
+	seen := make(map[uint16]bool)
+	for _, qtype := range u.resolver.Database.qtypesAt(u.resolver.Id, name) {
+		seen[qtype] = true
+		if len(u.rrset(name, qtype)) > 0 {
+			qtypes = append(qtypes, qtype)
+		}
+	}
+	for _, key := range u.changed {
+		if key.name == dns.CanonicalName(name) && !seen[key.qtype] && len(u.rrsets[key]) > 0 {
+			qtypes = append(qtypes, key.qtype)
+		}
+	}
+	return qtypes
+}
+
+// Applies one RR of the update section (RFC 2136 section 3.4.2)
+func (u *zoneUpdate) apply(rr dns.RR) {
+	header := rr.Header()
+	isApex := dns.CanonicalName(header.Name) == u.zone.canonicalApex()
+	switch header.Class {
+	case dns.ClassINET:
+		// Add to an RRset
+		rrset := u.rrset(header.Name, header.Rrtype)
+		switch header.Rrtype {
+		case dns.TypeSOA:
+			if isApex && serialNewer(rr.(*dns.SOA).Serial, rrset[0].(*dns.SOA).Serial) {
+				u.setRrset(header.Name, header.Rrtype, []dns.RR{rr})
+			}
+			return
+		case dns.TypeCNAME:
+			// A CNAME can't have other data, and there is only one
+			for _, qtype := range u.qtypesAt(header.Name) {
+				if qtype != dns.TypeCNAME {
+					return
+				}
+			}
+			u.setRrset(header.Name, header.Rrtype, []dns.RR{rr})
+			return
+		}
+		if len(u.rrset(header.Name, dns.TypeCNAME)) > 0 {
+			return
+		}
+		for i := range rrset {
+			if dns.IsDuplicate(rrset[i], rr) {
+				rrset[i] = rr
+				u.setRrset(header.Name, header.Rrtype, rrset)
+				return
+			}
+		}
+		u.setRrset(header.Name, header.Rrtype, append(rrset, rr))
+	case dns.ClassANY:
+		// Delete an RRset, or all RRsets of a name. The SOA and NS RRsets of the apex are kept.
+		qtypes := []uint16{header.Rrtype}
+		if header.Rrtype == dns.TypeANY {
+			qtypes = u.qtypesAt(header.Name)
+		}
+		for _, qtype := range qtypes {
+			if isApex && (qtype == dns.TypeSOA || qtype == dns.TypeNS) {
+				continue
+			}
+			// Not finding an RRset to delete is not an error
+			u.setRrset(header.Name, qtype, nil)
+		}
+	case dns.ClassNONE:
+		// Delete an RR from an RRset. The SOA and the last NS of the apex are kept.
+		if isApex && header.Rrtype == dns.TypeSOA {
+			return
+		}
+		deleted := dns.Copy(rr)
+		deleted.Header().Class = dns.ClassINET
+		var kept []dns.RR
+		for _, stored := range u.rrset(header.Name, header.Rrtype) {
+			if !dns.IsDuplicate(stored, deleted) {
+				kept = append(kept, stored)
+			}
+		}
+		if isApex && header.Rrtype == dns.TypeNS && len(kept) == 0 {
+			return
+		}
+		u.setRrset(header.Name, header.Rrtype, kept)
+	}
+}
+
+// Writes the changed RRsets. Each replaces the answer section of the DnsMessage for its name and type, other parts of
+// an existing DnsMessage, such as its authority section, are kept. Empty RRsets delete the DnsMessage. All DnsMessages
+// are built before the first is written, so that an RR we can't store changes nothing.
+func (u *zoneUpdate) write() error {
+	r := u.resolver
+	var written []DnsMessage
+	var deleted []rrsetKey
+	for _, key := range u.changed {
+		err, dnsMessage := r.Database.ReadResolverDnsMessage(r.Id, key.qtype, key.name)
+		if len(u.rrsets[key]) == 0 {
+			if err == nil {
+				deleted = append(deleted, key)
+			}
+			continue
+		}
+		if err != nil || dnsMessage.Expired() {
+			dnsMessage = &DnsMessage{Resolvers: []string{r.Id}, MsgHdr: DnsHeader{Authoritative: true}}
+		}
+		// Other questions of the DnsMessage keep their answer
+		dnsMessage.Question = []DnsQuestion{{Qname: key.name, Qtype: key.qtype, Qclass: dns.ClassINET}}
+		dnsMessage.Answer = nil
+		for _, rr := range u.rrsets[key] {
+			err, rrSection := dnsRRFromRR(rr)
+			if err != nil {
+				return err
+			}
+			dnsMessage.Answer = append(dnsMessage.Answer, rrSection)
+		}
+		written = append(written, *dnsMessage)
+	}
+	for _, dnsMessage := range written {
+		if err := r.Database.writeStoredDnsMessage(r.Id, dnsMessage); err != nil {
+			return err
+		}
+	}
+	for _, key := range deleted {
+		if err := r.Database.deleteResolverDnsMessage(r.Id, key.qtype, key.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
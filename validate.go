@@ -0,0 +1,689 @@
+package yesdns
+
+// DNSSEC validation of forwarded responses (RFC 4035 section 5).
+// Forwarded queries get DO and CD set, so forwarders return signatures and never hide bogus data from us. The chain
+// of trust is then followed down from the configured trust anchors by asking the same forwarders for DS and DNSKEY
+// records. Secure answers get AD, bogus answers become SERVFAIL, and insecure answers are passed through.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Results of validation
+const (
+	ValidationSecure   = "secure"
+	ValidationInsecure = "insecure"
+	ValidationBogus    = "bogus"
+)
+
+// How long validated zone keys are remembered at most. Bogus results are remembered for a short time only, so that
+// fixed zones recover quickly.
+const (
+	validationCacheTtl      = time.Hour
+	validationBogusCacheTtl = time.Minute
+)
+
+// Guards against chains of trust that are too long or loop
+const maxValidationDepth = 16
+
+// Signature algorithms we can verify
+var validationAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+// DS digest types we can check
+var validationDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+type DnssecValidation struct {
+	// DS or DNSKEY records in presentation format. For the public DNS these are the root zone KSKs published at
+	// https://data.iana.org/root-anchors/
+	TrustAnchors []string `json:"trust_anchors"`
+}
+
+func (v DnssecValidation) parseTrustAnchors() (error, []dns.RR) {
+	if len(v.TrustAnchors) == 0 {
+		return errors.New("dnssec_validation needs at least one trust anchor"), nil
+	}
+	var anchors []dns.RR
+	for _, trustAnchor := range v.TrustAnchors {
+		rr, err := dns.NewRR(trustAnchor)
+		if err != nil {
+			return err, nil
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			anchors = append(anchors, rr)
+		default:
+			return errors.New(fmt.Sprintf("Trust anchor is not a DS or DNSKEY record: %s", trustAnchor)), nil
+		}
+	}
+	return nil, anchors
+}
+
+func (r Resolver) validateDnssecValidation() error {
+	if r.DnssecValidation == nil {
+		return nil
+	}
+	err, _ := r.DnssecValidation.parseTrustAnchors()
+	return err
+}
+
+// Zone keys that were validated, or found to be insecure or bogus
+type validatedZone struct {
+	result  string
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+var validatedZones = struct {
+	sync.Mutex
+	byKey map[string]validatedZone
+}{byKey: make(map[string]validatedZone)}
+
+// Apexes found by zoneOf, so that every unsigned answer doesn't cost a SOA query
+type zoneApex struct {
+	apex    string
+	expires time.Time
+}
+
+var zoneApexes = struct {
+	sync.Mutex
+	byKey map[string]zoneApex
+}{byKey: make(map[string]zoneApex)}
+
+// Follows chains of trust for one resolver
+type validator struct {
+	resolver Resolver
+	anchors  []dns.RR
+	depth    int
+	// Owner names of RRsets that were validated with a signature of a wildcard, and how many labels the wildcard
+	// had without the *
+	expansions map[string]uint8
+}
+
+// Forwards dnsMsg like Resolver.forward, then validates the response. Clients that set CD get the response without
+// validation.
+func (r Resolver) forwardValidated(dnsMsg *dns.Msg, clientIp net.IP) (error, *dns.Msg) {
+	forwardDnsMsg := dnsMsg.Copy()
+	ensureOpt(forwardDnsMsg).SetDo()
+	forwardDnsMsg.CheckingDisabled = true
+	err, responseDnsMsg := r.forward(forwardDnsMsg, clientIp)
+	if err != nil || responseDnsMsg == nil {
+		return err, responseDnsMsg
+	}
+	responseDnsMsg.CheckingDisabled = dnsMsg.CheckingDisabled
+	responseDnsMsg.AuthenticatedData = false
+	if !dnsMsg.CheckingDisabled &&
+		(responseDnsMsg.Rcode == dns.RcodeSuccess || responseDnsMsg.Rcode == dns.RcodeNameError) {
+		err, anchors := r.DnssecValidation.parseTrustAnchors()
+		if err != nil {
+			// Caught when the resolver is saved, so this should not happen
+			logger.Error("Invalid trust anchors", "resolver", r.Id, "error", err)
+			anchors = nil
+		}
+		v := &validator{resolver: r, anchors: anchors}
+		result := v.validate(dnsMsg.Question[0], responseDnsMsg)
+		metricDnssecValidations.Inc(r.Id, result)
+		switch result {
+		case ValidationSecure:
+			// RFC 6840 section 5.7
+			responseDnsMsg.AuthenticatedData = dnssecOk(dnsMsg) || dnsMsg.AuthenticatedData
+		case ValidationBogus:
+			logger.Warn("Bogus DNSSEC response", "resolver", r.Id, "qname", dnsMsg.Question[0].Name,
+				"qtype", dns.TypeToString[dnsMsg.Question[0].Qtype])
+			failDnsMsg := new(dns.Msg)
+			failDnsMsg.SetRcode(dnsMsg, dns.RcodeServerFailure)
+			failDnsMsg.RecursionAvailable = responseDnsMsg.RecursionAvailable
+			responseDnsMsg = failDnsMsg
+		}
+	}
+	if !dnssecOk(dnsMsg) {
+		stripDnssecRecords(responseDnsMsg, dnsMsg.Question[0].Qtype)
+	}
+	return nil, responseDnsMsg
+}
+
+// Removes the DNSSEC records a client did not ask for (RFC 4035 section 3.2.1)
+func stripDnssecRecords(msg *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	msg.Extra = strip(msg.Extra)
+}
+
+// Returns ValidationSecure, ValidationInsecure or ValidationBogus for a response to question
+func (v *validator) validate(question dns.Question, responseDnsMsg *dns.Msg) string {
+	if len(responseDnsMsg.Answer) > 0 {
+		v.expansions = make(map[string]uint8)
+		result := v.validateSection(responseDnsMsg.Answer, question.Name)
+		if result != ValidationSecure || len(v.expansions) == 0 {
+			return result
+		}
+		return v.wildcardProof(question, responseDnsMsg)
+	}
+	// Negative answer. The SOA and NSEC records in the authority section must be secure, and prove it.
+	if len(responseDnsMsg.Ns) == 0 {
+		return v.validateUnsigned(question.Name)
+	}
+	if result := v.validateSection(responseDnsMsg.Ns, question.Name); result != ValidationSecure {
+		return result
+	}
+	nsecs, nsec3s := denialRecords(responseDnsMsg.Ns)
+	if len(nsecs) == 0 && len(nsec3s) > 0 {
+		return nsec3Proof(question, responseDnsMsg.Rcode, nsec3s)
+	}
+	if responseDnsMsg.Rcode == dns.RcodeNameError {
+		return nxdomainProof(question.Name, nsecs)
+	}
+	return nodataProof(question, nsecs)
+}
+
+func denialRecords(rrs []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// Answers that were expanded from a wildcard need an NSEC or NSEC3 in the authority section that proves that there is
+// no closer match, i.e. that the next closer name doesn't exist (RFC 4035 section 5.3.4, RFC 5155 section 8.8)
+func (v *validator) wildcardProof(question dns.Question, responseDnsMsg *dns.Msg) string {
+	expansions := v.expansions
+	if len(responseDnsMsg.Ns) == 0 {
+		return ValidationBogus
+	}
+	if result := v.validateSection(responseDnsMsg.Ns, question.Name); result != ValidationSecure {
+		return result
+	}
+	nsecs, nsec3s := denialRecords(responseDnsMsg.Ns)
+	usable, expensive := usableNsec3s(nsec3s)
+	if expensive {
+		return ValidationInsecure
+	}
+	for name, labels := range expansions {
+		nextCloser := lastLabels(name, int(labels)+1)
+		proven := nsec3Covering(usable, nextCloser) != nil
+		for _, nsec := range nsecs {
+			proven = proven || nsecCovers(nsec, nextCloser)
+		}
+		if !proven {
+			logger.Debug("Wildcard answer without proof of no closer match", "resolver", v.resolver.Id,
+				"name", name)
+			return ValidationBogus
+		}
+	}
+	return ValidationSecure
+}
+
+// Validates every RRset in rrs. The result is the worst of all RRsets.
+func (v *validator) validateSection(rrs []dns.RR, qname string) string {
+	rrsetKeys, rrsets, rrsigs := groupRrsets(rrs)
+	result := ValidationSecure
+	for _, rrsetKey := range rrsetKeys {
+		rrset := rrsets[rrsetKey]
+		switch v.validateRrset(rrset, rrsigs[rrsetKey], false) {
+		case ValidationBogus:
+			return ValidationBogus
+		case ValidationInsecure:
+			result = ValidationInsecure
+		}
+	}
+	if len(rrsetKeys) == 0 {
+		// Nothing but signatures
+		return v.validateUnsigned(qname)
+	}
+	return result
+}
+
+// Validates rrset with the first signature that can be verified. If parentOnly is set, only signatures by zones
+// above the owner of rrset count, as for DS records.
+func (v *validator) validateRrset(rrset []dns.RR, rrsigs []*dns.RRSIG, parentOnly bool) string {
+	name := dns.CanonicalName(rrset[0].Header().Name)
+	result := ValidationBogus
+	signers := 0
+	for _, rrsig := range rrsigs {
+		signer := dns.CanonicalName(rrsig.SignerName)
+		if !dns.IsSubDomain(signer, name) || (parentOnly && signer == name) {
+			continue
+		}
+		signers++
+		zoneResult, keys := v.zoneKeys(signer)
+		if zoneResult == ValidationInsecure {
+			result = ValidationInsecure
+			continue
+		}
+		if zoneResult == ValidationSecure && verifyRrset(rrset, rrsig, keys) {
+			if isWildcardExpansion(name, rrsig) && v.expansions != nil {
+				v.expansions[name] = rrsig.Labels
+			}
+			return ValidationSecure
+		}
+	}
+	if signers == 0 && parentOnly {
+		return v.validateUnsigned(parentName(name))
+	}
+	if signers == 0 {
+		return v.validateUnsigned(name)
+	}
+	return result
+}
+
+// Unsigned data is fine in insecure zones only
+func (v *validator) validateUnsigned(name string) string {
+	zone := v.zoneOf(name)
+	if zone == "" {
+		if v.anchorCovers(name) {
+			return ValidationBogus
+		}
+		return ValidationInsecure
+	}
+	if result, _ := v.zoneKeys(zone); result == ValidationInsecure {
+		return ValidationInsecure
+	}
+	return ValidationBogus
+}
+
+// True if rrsig signed a wildcard that name was expanded from. Its labels field doesn't count the * label.
+func isWildcardExpansion(name string, rrsig *dns.RRSIG) bool {
+	labels := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		labels--
+	}
+	return int(rrsig.Labels) < labels
+}
+
+func verifyRrset(rrset []dns.RR, rrsig *dns.RRSIG, keys []*dns.DNSKEY) bool {
+	if !rrsig.ValidityPeriod(time.Now()) {
+		return false
+	}
+	for _, key := range keys {
+		if key.Algorithm == rrsig.Algorithm && key.KeyTag() == rrsig.KeyTag && key.Flags&dns.ZONE != 0 &&
+			dns.CanonicalName(key.Hdr.Name) == dns.CanonicalName(rrsig.SignerName) &&
+			rrsig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// True if a trust anchor is at name or above it
+func (v *validator) anchorCovers(name string) bool {
+	for _, anchor := range v.anchors {
+		if dns.IsSubDomain(dns.CanonicalName(anchor.Header().Name), dns.CanonicalName(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the validated DNSKEYs of zone, if it is secure
+func (v *validator) zoneKeys(zone string) (string, []*dns.DNSKEY) {
+	zone = dns.CanonicalName(zone)
+	cacheKey := v.resolver.Id + "|" + strings.Join(v.resolver.DnssecValidation.TrustAnchors, "|") + "|" + zone
+	validatedZones.Lock()
+	cached, ok := validatedZones.byKey[cacheKey]
+	validatedZones.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.result, cached.keys
+	}
+	if v.depth >= maxValidationDepth {
+		logger.Warn("DNSSEC chain of trust too long", "resolver", v.resolver.Id, "zone", zone)
+		return ValidationBogus, nil
+	}
+	v.depth++
+	result, keys, ttl := v.findZoneKeys(zone)
+	v.depth--
+	if result == ValidationBogus {
+		ttl = validationBogusCacheTtl
+	} else if ttl > validationCacheTtl {
+		ttl = validationCacheTtl
+	}
+	logger.Debug("Validated zone keys", "resolver", v.resolver.Id, "zone", zone, "result", result)
+	validatedZones.Lock()
+	validatedZones.byKey[cacheKey] = validatedZone{result: result, keys: keys, expires: time.Now().Add(ttl)}
+	validatedZones.Unlock()
+	return result, keys
+}
+
+func (v *validator) findZoneKeys(zone string) (string, []*dns.DNSKEY, time.Duration) {
+	var anchors []dns.RR
+	for _, anchor := range v.anchors {
+		if dns.CanonicalName(anchor.Header().Name) == zone {
+			anchors = append(anchors, anchor)
+		}
+	}
+	if len(anchors) > 0 {
+		return v.trustedKeys(zone, anchors)
+	}
+	if !v.anchorCovers(zone) {
+		return ValidationInsecure, nil, validationCacheTtl
+	}
+	// Follow the DS records in the parent zone
+	responseDnsMsg := v.query(zone, dns.TypeDS)
+	if responseDnsMsg == nil {
+		return ValidationBogus, nil, 0
+	}
+	rrsetKeys, rrsets, rrsigs := groupRrsets(responseDnsMsg.Answer)
+	for _, rrsetKey := range rrsetKeys {
+		rrset := rrsets[rrsetKey]
+		if rrset[0].Header().Rrtype != dns.TypeDS || dns.CanonicalName(rrset[0].Header().Name) != zone {
+			continue
+		}
+		if result := v.validateRrset(rrset, rrsigs[rrsetKey], true); result != ValidationSecure {
+			return result, nil, validationCacheTtl
+		}
+		return v.trustedKeys(zone, rrset)
+	}
+	// No DS, so the parent must prove that zone is an insecure delegation: zone has NS, but neither DS nor SOA,
+	// which only the child zone would have (RFC 6840 section 4.4)
+	var nsec3s []*dns.NSEC3
+	ttl := validationCacheTtl
+	rrsetKeys, rrsets, rrsigs = groupRrsets(responseDnsMsg.Ns)
+	for _, rrsetKey := range rrsetKeys {
+		rrset := rrsets[rrsetKey]
+		switch rrset[0].Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		result := v.validateRrset(rrset, rrsigs[rrsetKey], true)
+		if result == ValidationInsecure {
+			return ValidationInsecure, nil, validationCacheTtl
+		}
+		if result != ValidationSecure {
+			continue
+		}
+		if ttlDuration(rrset[0].Header().Ttl) < ttl {
+			ttl = ttlDuration(rrset[0].Header().Ttl)
+		}
+		switch rr := rrset[0].(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(rr.Hdr.Name) == zone && nsecHasType(rr, dns.TypeNS) &&
+				!nsecHasType(rr, dns.TypeDS) && !nsecHasType(rr, dns.TypeSOA) {
+				return ValidationInsecure, nil, ttlDuration(rr.Hdr.Ttl)
+			}
+		case *dns.NSEC3:
+			for _, rr := range rrset {
+				nsec3s = append(nsec3s, rr.(*dns.NSEC3))
+			}
+		}
+	}
+	if len(nsec3s) > 0 && nsec3InsecureDelegation(zone, nsec3s) == ValidationInsecure {
+		return ValidationInsecure, nil, ttl
+	}
+	return ValidationBogus, nil, 0
+}
+
+// Fetches the DNSKEYs of zone and trusts them if one of them matches an anchor (a DS or DNSKEY) and signed them all.
+// Zones whose anchors all use algorithms we don't support are insecure (RFC 4035 section 5.2).
+func (v *validator) trustedKeys(zone string, anchors []dns.RR) (string, []*dns.DNSKEY, time.Duration) {
+	supported := false
+	for _, anchor := range anchors {
+		switch anchor := anchor.(type) {
+		case *dns.DS:
+			supported = supported || validationAlgorithms[anchor.Algorithm] && validationDigests[anchor.DigestType]
+		case *dns.DNSKEY:
+			supported = supported || validationAlgorithms[anchor.Algorithm]
+		}
+	}
+	if !supported {
+		return ValidationInsecure, nil, validationCacheTtl
+	}
+	responseDnsMsg := v.query(zone, dns.TypeDNSKEY)
+	if responseDnsMsg == nil {
+		return ValidationBogus, nil, 0
+	}
+	var keyRrset []dns.RR
+	var keys []*dns.DNSKEY
+	var rrsigs []*dns.RRSIG
+	ttl := validationCacheTtl
+	for _, rr := range responseDnsMsg.Answer {
+		if dns.CanonicalName(rr.Header().Name) != zone {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keyRrset = append(keyRrset, rr)
+			keys = append(keys, rr)
+			if ttlDuration(rr.Hdr.Ttl) < ttl {
+				ttl = ttlDuration(rr.Hdr.Ttl)
+			}
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				rrsigs = append(rrsigs, rr)
+			}
+		}
+	}
+	for _, key := range keys {
+		if !matchesAnchor(key, anchors) {
+			continue
+		}
+		for _, rrsig := range rrsigs {
+			if verifyRrset(keyRrset, rrsig, []*dns.DNSKEY{key}) {
+				return ValidationSecure, keys, ttl
+			}
+		}
+	}
+	return ValidationBogus, nil, 0
+}
+
+func matchesAnchor(key *dns.DNSKEY, anchors []dns.RR) bool {
+	for _, anchor := range anchors {
+		switch anchor := anchor.(type) {
+		case *dns.DS:
+			if ds := key.ToDS(anchor.DigestType); ds != nil && ds.KeyTag == anchor.KeyTag &&
+				ds.Algorithm == anchor.Algorithm && strings.EqualFold(ds.Digest, anchor.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if key.Algorithm == anchor.Algorithm && key.Protocol == anchor.Protocol && key.PublicKey == anchor.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the apex of the zone name is in, as told by the SOA the forwarders return, or "" if it is unknown
+func (v *validator) zoneOf(name string) string {
+	cacheKey := v.resolver.Id + "|" + dns.CanonicalName(name)
+	zoneApexes.Lock()
+	cached, ok := zoneApexes.byKey[cacheKey]
+	zoneApexes.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.apex
+	}
+	responseDnsMsg := v.query(name, dns.TypeSOA)
+	if responseDnsMsg == nil {
+		return ""
+	}
+	// Remember that there is no SOA for a short time only, like bogus zone keys
+	found := zoneApex{expires: time.Now().Add(validationBogusCacheTtl)}
+	for _, rr := range append(append([]dns.RR{}, responseDnsMsg.Answer...), responseDnsMsg.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(dns.CanonicalName(soa.Hdr.Name), dns.CanonicalName(name)) {
+			ttl := ttlDuration(soa.Hdr.Ttl)
+			if ttl > validationCacheTtl {
+				ttl = validationCacheTtl
+			}
+			found = zoneApex{apex: soa.Hdr.Name, expires: time.Now().Add(ttl)}
+			break
+		}
+	}
+	zoneApexes.Lock()
+	zoneApexes.byKey[cacheKey] = found
+	zoneApexes.Unlock()
+	return found.apex
+}
+
+// Asks the forwarders of the resolver for DNSSEC records
+func (v *validator) query(name string, qtype uint16) *dns.Msg {
+	dnsMsg := new(dns.Msg)
+	dnsMsg.SetQuestion(dns.Fqdn(name), qtype)
+	dnsMsg.SetEdns0(dns.DefaultMsgSize, true)
+	dnsMsg.CheckingDisabled = true
+	err, responseDnsMsg := v.resolver.forward(dnsMsg, nil)
+	if err != nil || responseDnsMsg == nil {
+		logger.Debug("DNSSEC validation query failed", "qname", name, "qtype", dns.TypeToString[qtype], "error", err)
+		return nil
+	}
+	return responseDnsMsg
+}
+
+// Groups rrs into RRsets by name and type, and the signatures that cover them
+func groupRrsets(rrs []dns.RR) ([]string, map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	var rrsetKeys []string
+	rrsets := make(map[string][]dns.RR)
+	rrsigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		if rrsig, ok := rr.(*dns.RRSIG); ok {
+			rrsetKey := name + "/" + dns.Type(rrsig.TypeCovered).String()
+			rrsigs[rrsetKey] = append(rrsigs[rrsetKey], rrsig)
+			continue
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG:
+			continue
+		}
+		rrsetKey := name + "/" + dns.Type(rr.Header().Rrtype).String()
+		if _, ok := rrsets[rrsetKey]; !ok {
+			rrsetKeys = append(rrsetKeys, rrsetKey)
+		}
+		rrsets[rrsetKey] = append(rrsets[rrsetKey], rr)
+	}
+	return rrsetKeys, rrsets, rrsigs
+}
+
+// NXDOMAIN needs an NSEC that covers qname, and one that covers the wildcard at the closest encloser
+// (RFC 4035 section 5.4)
+func nxdomainProof(qname string, nsecs []*dns.NSEC) string {
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, qname) {
+			continue
+		}
+		labels := dns.CompareDomainName(qname, nsec.Hdr.Name)
+		if nextLabels := dns.CompareDomainName(qname, nsec.NextDomain); nextLabels > labels {
+			labels = nextLabels
+		}
+		wildcard := wildcardAt(lastLabels(qname, labels))
+		for _, wildcardNsec := range nsecs {
+			if nsecCovers(wildcardNsec, wildcard) {
+				return ValidationSecure
+			}
+		}
+	}
+	return ValidationBogus
+}
+
+// NODATA needs an NSEC at qname without the queried type or CNAME (RFC 4035 section 5.4).
+// Compact denial of existence (RFC 9824) answers nonexistent names in the same way.
+// Empty non-terminals have an NSEC around them whose next name is below qname (RFC 4592 section 2.2.2).
+// Names that only a wildcard matches need an NSEC that covers qname, and one at the wildcard without the queried type.
+func nodataProof(question dns.Question, nsecs []*dns.NSEC) string {
+	qname := dns.CanonicalName(question.Name)
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == qname &&
+			!nsecHasType(nsec, question.Qtype) && !nsecHasType(nsec, dns.TypeCNAME) {
+			return ValidationSecure
+		}
+		if !nsecCovers(nsec, qname) {
+			continue
+		}
+		if next := dns.CanonicalName(nsec.NextDomain); next != qname && dns.IsSubDomain(qname, next) {
+			return ValidationSecure
+		}
+		labels := dns.CompareDomainName(qname, nsec.Hdr.Name)
+		if nextLabels := dns.CompareDomainName(qname, nsec.NextDomain); nextLabels > labels {
+			labels = nextLabels
+		}
+		wildcard := wildcardAt(lastLabels(qname, labels))
+		for _, wildcardNsec := range nsecs {
+			if dns.CanonicalName(wildcardNsec.Hdr.Name) == wildcard &&
+				!nsecHasType(wildcardNsec, question.Qtype) && !nsecHasType(wildcardNsec, dns.TypeCNAME) {
+				return ValidationSecure
+			}
+		}
+	}
+	return ValidationBogus
+}
+
+func nsecHasType(nsec *dns.NSEC, qtype uint16) bool {
+	for _, t := range nsec.TypeBitMap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// True if name sorts between the owner and next name of nsec. The last NSEC of a zone wraps around to the apex.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	afterOwner := canonicalCompare(nsec.Hdr.Name, name) < 0
+	beforeNext := canonicalCompare(name, nsec.NextDomain) < 0
+	if canonicalCompare(nsec.Hdr.Name, nsec.NextDomain) < 0 {
+		return afterOwner && beforeNext
+	}
+	return afterOwner || beforeNext
+}
+
+// Compares names in the canonical order of RFC 4034 section 6.1
+func canonicalCompare(a string, b string) int {
+	aLabels := dns.SplitDomainName(dns.CanonicalName(a))
+	bLabels := dns.SplitDomainName(dns.CanonicalName(b))
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		if c := bytes.Compare(unescapeLabel(aLabels[len(aLabels)-i]), unescapeLabel(bLabels[len(bLabels)-i])); c != 0 {
+			return c
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+// The rightmost count labels of name
+func lastLabels(name string, count int) string {
+	labels := dns.SplitDomainName(name)
+	if count <= 0 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-count:], "."))
+}
+
+func ttlDuration(ttl uint32) time.Duration {
+	return time.Duration(ttl) * time.Second
+}
@@ -0,0 +1,145 @@
+package yesdns
+
+// Split-horizon DNS. A resolver can define views that match clients by source address or by EDNS Client Subnet.
+// DnsMessages that belong to a view are only served to clients in that view, and take precedence over DnsMessages
+// that don't belong to any view.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+type ResolverView struct {
+	Name string `json:"name"`
+	// Matched against the source address of the query
+	ClientCidrs []string `json:"client_cidrs"`
+	// Matched against the address in the ECS option of the query
+	EcsCidrs []string `json:"ecs_cidrs,omitempty"`
+}
+
+// Returns the name of the first view that matches, or "" if none does. Views that match ecsIp take precedence
+// over views that match clientIp. The returned bool is true if the view was matched by ecsIp.
+// Either IP may be nil.
+func (r Resolver) matchView(clientIp net.IP, ecsIp net.IP) (string, bool) {
+	if ecsIp != nil {
+		for _, view := range r.Views {
+			if cidrsContain(view.EcsCidrs, ecsIp) {
+				return view.Name, true
+			}
+		}
+	}
+	if clientIp != nil {
+		for _, view := range r.Views {
+			if cidrsContain(view.ClientCidrs, clientIp) {
+				return view.Name, false
+			}
+		}
+	}
+	return "", false
+}
+
+// DnsMessages in a view are stored as if they belonged to a resolver named resolverId@view
+func viewStorageId(resolverId string, view string) string {
+	if view == "" {
+		return resolverId
+	}
+	return resolverId + "@" + view
+}
+
+// View names become part of storage ids (see viewStorageId), and so of file names in the Database
+func validateViewName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\@#") || strings.Contains(name, "..") {
+		return errors.New(fmt.Sprintf("Invalid view name '%s'. Must not be empty or contain /, \\, @, # or ..", name))
+	}
+	return nil
+}
+
+// Checks that views have valid and unique names, and valid CIDRs
+func (r Resolver) validateViews() error {
+	names := make(map[string]bool)
+	for _, view := range r.Views {
+		if err := validateViewName(view.Name); err != nil {
+			return err
+		}
+		if names[view.Name] {
+			return errors.New(fmt.Sprintf("View %s is defined more than once", view.Name))
+		}
+		names[view.Name] = true
+		if err := validateCidrs(view.ClientCidrs); err != nil {
+			return err
+		}
+		if err := validateCidrs(view.EcsCidrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns an error for the first entry of cidrs that is neither a CIDR nor an IP address
+func validateCidrs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if parseCidr(cidr) == nil {
+			return errors.New(fmt.Sprintf("Invalid CIDR '%s'", cidr))
+		}
+	}
+	return nil
+}
+
+// Parsed CIDRs, so we don't parse them on every query. nil means the CIDR is invalid.
+var cidrNetworks = struct {
+	sync.RWMutex
+	byCidr map[string]*net.IPNet
+}{byCidr: make(map[string]*net.IPNet)}
+
+// Returns the network of a CIDR, or nil if it is invalid. Plain IP addresses are networks of that address only.
+func parseCidr(cidr string) *net.IPNet {
+	cidrNetworks.RLock()
+	network, ok := cidrNetworks.byCidr[cidr]
+	cidrNetworks.RUnlock()
+	if ok {
+		return network
+	}
+	if _, network, _ = net.ParseCIDR(cidr); network == nil {
+		if ip := net.ParseIP(cidr); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		} else {
+			logger.Warn("Invalid CIDR", "cidr", cidr)
+		}
+	}
+	cidrNetworks.Lock()
+	cidrNetworks.byCidr[cidr] = network
+	cidrNetworks.Unlock()
+	return network
+}
+
+// True if ip is in any of cidrs. Invalid entries never match.
+func cidrsContain(cidrs []string, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if network := parseCidr(cidr); network != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IP address of a client, or nil if it can't be determined.
+func addrIp(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	if addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return net.ParseIP(host)
+		}
+	}
+	return nil
+}
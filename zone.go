@@ -0,0 +1,215 @@
+package yesdns
+
+// Zones a resolver is authoritative for. Queries for names in a zone are never forwarded. Negative answers
+// distinguish names that don't exist (NXDOMAIN) from names without records of the queried type (NODATA), and carry
+// the zone's SOA. Zones can be signed with DNSSEC, see dnssec.go.
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+type Zone struct {
+	// Name of the zone, e.g. example.com.
+	Apex string `json:"apex"`
+	// Online DNSSEC signing. Needs a key, see /v1/dnssec-keys.
+	Dnssec *ZoneDnssec `json:"dnssec,omitempty"`
+	// Zone transfers to secondaries. Refused if not set.
+	Transfer *ZoneTransfer `json:"transfer,omitempty"`
+	// Secondaries to send NOTIFY to when the zone changes, as host:port
+	Notify []string `json:"notify,omitempty"`
+	// Makes this a secondary zone that is transferred from the primary, see secondary.go
+	Primary *ZonePrimary `json:"primary,omitempty"`
+	// Dynamic updates (RFC 2136). Refused if not set.
+	Update *ZoneUpdate `json:"update,omitempty"`
+}
+
+func (z Zone) canonicalApex() string {
+	return dns.CanonicalName(z.Apex)
+}
+
+// True if name is the apex of z or below it
+func (z Zone) Contains(name string) bool {
+	return dns.IsSubDomain(z.canonicalApex(), dns.CanonicalName(name))
+}
+
+// Returns the zone of r that name is in, the most specific one if zones are nested, or nil if there is none.
+func (r Resolver) zoneFor(name string) *Zone {
+	var found *Zone
+	for i := range r.Zones {
+		if r.Zones[i].Contains(name) &&
+			(found == nil || dns.CountLabel(r.Zones[i].canonicalApex()) > dns.CountLabel(found.canonicalApex())) {
+			found = &r.Zones[i]
+		}
+	}
+	return found
+}
+
+// Like zoneFor, but DS records at the apex of a zone belong to the parent zone
+func (r Resolver) zoneForQuestion(question dns.Question) *Zone {
+	zone := r.zoneFor(question.Name)
+	if zone != nil && question.Qtype == dns.TypeDS && zone.canonicalApex() == dns.CanonicalName(question.Name) &&
+		zone.canonicalApex() != "." {
+		return r.zoneFor(parentName(question.Name))
+	}
+	return zone
+}
+
+// Returns the SOA of zone, with the serial of the latest journaled change if that is newer (see journal.go).
+func (r Resolver) zoneSoa(zone Zone) *dns.SOA {
+	soa := r.storedZoneSoa(zone)
+	if err, journal := r.Database.readZoneJournal(r.Id, zone.Apex); err == nil && serialNewer(journal.Serial, soa.Serial) {
+		soa.Serial = journal.Serial
+	}
+	return soa
+}
+
+// Returns the first SOA in the DnsMessage for the apex SOA question if there is one, otherwise a made up SOA.
+// Secondary zones use the SOA transferred from the primary, unless it is overridden.
+func (r Resolver) storedZoneSoa(zone Zone) *dns.SOA {
+	apex := dns.Fqdn(zone.Apex)
+	for _, storageId := range r.zoneStorageIds(zone) {
+		err, dnsMessage := r.Database.ReadResolverDnsMessage(storageId, dns.TypeSOA, apex)
+		if err != nil || dnsMessage.Expired() {
+			continue
+		}
+		var rrs []dns.RR
+		for _, rrSection := range dnsMessage.Answer {
+			if rrSection.Type == dns.TypeSOA {
+				if err := appendRR(&rrs, &rrSection); err != nil {
+					logger.Warn("Cant build zone SOA", "zone", apex, "error", err)
+				}
+			}
+		}
+		if len(rrs) > 0 {
+			return rrs[0].(*dns.SOA)
+		}
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: apex, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:      "ns1." + apex,
+		Mbox:    "hostmaster." + apex,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  300,
+	}
+}
+
+// TTL of negative answers (RFC 2308)
+func negativeTtl(soa *dns.SOA) uint32 {
+	if soa.Minttl < soa.Hdr.Ttl {
+		return soa.Minttl
+	}
+	return soa.Hdr.Ttl
+}
+
+// Storage ids that DnsMessages for a client are looked up in, most specific first (see Resolver.Resolve)
+func (r Resolver) storageIds(clientIp net.IP, ecsIp net.IP) []string {
+	if view, _ := r.matchView(clientIp, ecsIp); view != "" {
+		return []string{viewStorageId(r.Id, view), r.Id}
+	}
+	return []string{r.Id}
+}
+
+// Storage ids that DnsMessages for name and a client are looked up in, including a secondary zone's
+func (r Resolver) storageIdsFor(name string, clientIp net.IP, ecsIp net.IP) []string {
+	storageIds := r.storageIds(clientIp, ecsIp)
+	if storageId := r.secondaryStorageIdFor(name); storageId != "" {
+		storageIds = append(storageIds, storageId)
+	}
+	return storageIds
+}
+
+// Qtypes that exist at name for a client
+func (r Resolver) qtypesAt(name string, clientIp net.IP, ecsIp net.IP) []uint16 {
+	var qtypes []uint16
+	seen := make(map[uint16]bool)
+	for _, storageId := range r.storageIdsFor(name, clientIp, ecsIp) {
+		for _, qtype := range r.Database.qtypesAt(storageId, name) {
+			if !seen[qtype] {
+				seen[qtype] = true
+				qtypes = append(qtypes, qtype)
+			}
+		}
+	}
+	return qtypes
+}
+
+// True if there are names below name for a client, which makes name an empty non-terminal if it has no records itself
+func (r Resolver) hasNamesBelow(name string, clientIp net.IP, ecsIp net.IP) bool {
+	for _, storageId := range r.storageIdsFor(name, clientIp, ecsIp) {
+		if r.Database.hasNamesBelow(storageId, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the authoritative answer for a query in zone. responseDnsMsg is the result of internal resolution, and found
+// tells if it was built from a DnsMessage. Synthesizes SOA and DNSKEY answers at the apex, turns failed lookups into
+// NXDOMAIN or NODATA with the zone's SOA, and signs the response if the client asked for DNSSEC.
+func (r Resolver) zoneResponse(zone Zone, requestDnsMsg *dns.Msg, responseDnsMsg *dns.Msg, found bool,
+	clientIp net.IP, ecsIp net.IP) *dns.Msg {
+	question := requestDnsMsg.Question[0]
+	key := r.zoneKey(zone)
+	isApex := dns.CanonicalName(question.Name) == zone.canonicalApex()
+
+	if isApex && question.Qtype == dns.TypeSOA {
+		// Secondaries poll the SOA, so it must have the serial of the latest journaled change
+		soa := r.zoneSoa(zone)
+		if !found {
+			responseDnsMsg = new(dns.Msg)
+			responseDnsMsg.SetReply(requestDnsMsg)
+			responseDnsMsg.Authoritative = true
+		}
+		answer := []dns.RR{soa}
+		for _, rr := range responseDnsMsg.Answer {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				answer = append(answer, rr)
+			}
+		}
+		responseDnsMsg.Answer = answer
+	}
+
+	if !found && responseDnsMsg.Rcode == dns.RcodeNameError {
+		qtypes := r.qtypesAt(question.Name, clientIp, ecsIp)
+		negativeDnsMsg := new(dns.Msg)
+		negativeDnsMsg.SetReply(requestDnsMsg)
+		negativeDnsMsg.Authoritative = true
+		if key != nil && question.Qtype == dns.TypeDNSKEY && isApex {
+			negativeDnsMsg.Answer = []dns.RR{key.dnskeyRR()}
+		} else {
+			soa := r.zoneSoa(zone)
+			// The SOA is cached for as long as the negative answer (RFC 2308 section 3)
+			negativeSoa := dns.Copy(soa)
+			negativeSoa.Header().Ttl = negativeTtl(soa)
+			negativeDnsMsg.Ns = []dns.RR{negativeSoa}
+			// The apex always exists, and so do empty non-terminals. Names that don't exist but match a wildcard
+			// (see Resolver.lookup) exist as far as the client can tell, just not with this type.
+			var wildcardQtypes []uint16
+			if len(qtypes) == 0 && !isApex && !r.hasNamesBelow(question.Name, clientIp, ecsIp) {
+				wildcardQtypes = r.qtypesAt(qnameToWildcard(question.Name), clientIp, ecsIp)
+				if len(wildcardQtypes) == 0 {
+					negativeDnsMsg.Rcode = dns.RcodeNameError
+				}
+			}
+			if key != nil && dnssecOk(requestDnsMsg) {
+				if len(wildcardQtypes) > 0 {
+					negativeDnsMsg.Ns = append(negativeDnsMsg.Ns, zone.wildcardDenial(question.Name, wildcardQtypes, negativeTtl(soa))...)
+				} else {
+					negativeDnsMsg.Ns = append(negativeDnsMsg.Ns, zone.denial(question.Name, qtypes, negativeDnsMsg, negativeTtl(soa))...)
+				}
+			}
+		}
+		responseDnsMsg = negativeDnsMsg
+	}
+
+	if key != nil && dnssecOk(requestDnsMsg) {
+		key.signSection(&responseDnsMsg.Answer, zone)
+		key.signSection(&responseDnsMsg.Ns, zone)
+	}
+	return responseDnsMsg
+}